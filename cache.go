@@ -0,0 +1,197 @@
+// Caching the output of virtual rules, so that rules such as tests are not
+// rerun when nothing they depend on has changed.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directory, in the state directory, holding cached output.
+const cacheDir = "cache"
+
+// Cached output unused for longer than this is removed.
+const cacheMaxAge = 30 * 24 * time.Hour
+
+// Total size the cache is kept within, removing the least recently used
+// output first.
+const cacheMaxSize = 256 << 20
+
+// Hash a recipe, the program that executes it, and the contents of every file
+// the node transitively depends on.
+func hashInputs(u *node, program string, args []string, recipe string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %q\n%s\n", program, args, recipe)
+
+	prereqs := make(map[string]bool)
+	u.collectPrereqs(prereqs)
+	names := make([]string, 0, len(prereqs))
+	for name := range prereqs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(h, "%q ", name)
+		file, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintf(h, "missing\n")
+			continue
+		}
+		info, err := file.Stat()
+		if err == nil && !info.IsDir() {
+			fmt.Fprintf(h, "%d\n", info.Size())
+			io.Copy(h, file)
+		} else {
+			fmt.Fprintf(h, "directory\n")
+		}
+		file.Close()
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Path of the cached standard out or error for a hash.
+func cachePath(hash string, stream string) string {
+	return filepath.Join(mkStateDir, cacheDir, hash+"."+stream)
+}
+
+// If a recipe with the given hash has succeeded before, print its output and
+// return true.
+func replayCached(target string, hash string, replay bool) bool {
+	stdout, err := ioutil.ReadFile(cachePath(hash, "out"))
+	if err != nil {
+		return false
+	}
+	stderr, err := ioutil.ReadFile(cachePath(hash, "err"))
+	if err != nil {
+		return false
+	}
+
+	// the time standard out was modified is when the entry was last used
+	now := time.Now()
+	os.Chtimes(cachePath(hash, "out"), now, now)
+
+	mkPrintMessage(fmt.Sprintf("%s: (cached)", target))
+	if replay {
+		os.Stdout.Write(stdout)
+		os.Stderr.Write(stderr)
+	}
+	return true
+}
+
+// Output of a recipe, copied to mk's own as it's written and kept for the
+// cache.
+type teeOutput struct {
+	stdout, stderr *os.File // write ends, given to the recipe
+	outbuf, errbuf bytes.Buffer
+	done           sync.WaitGroup
+}
+
+func newTeeOutput() *teeOutput {
+	t := &teeOutput{}
+	t.stdout = t.tee(os.Stdout, &t.outbuf)
+	t.stderr = t.tee(os.Stderr, &t.errbuf)
+	return t
+}
+
+// Return the write end of a pipe whose contents go to both dst and buf.
+func (t *teeOutput) tee(dst *os.File, buf *bytes.Buffer) *os.File {
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	t.done.Add(1)
+	go func() {
+		io.Copy(io.MultiWriter(dst, buf), r)
+		r.Close()
+		t.done.Done()
+	}()
+	return w
+}
+
+// Wait, once the recipe has exited, until all it wrote has been copied.
+func (t *teeOutput) wait() {
+	t.stdout.Close()
+	t.stderr.Close()
+	t.done.Wait()
+}
+
+// Record a successful recipe's output under its hash.
+func saveCached(hash string, t *teeOutput) {
+	err := os.MkdirAll(filepath.Join(mkStateDir, cacheDir), 0755)
+	if err == nil {
+		// standard out is written last, marking the entry complete
+		err = ioutil.WriteFile(cachePath(hash, "err"), t.errbuf.Bytes(), 0644)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(cachePath(hash, "out"), t.outbuf.Bytes(), 0644)
+	}
+	if err != nil {
+		mkPrintError(fmt.Sprintf("mk: unable to cache output: %s", err))
+		return
+	}
+	pruneCache()
+}
+
+// Remove cached output not used within cacheMaxAge, then the least recently
+// used until what's left fits in cacheMaxSize.
+func pruneCache() {
+	dir := filepath.Join(mkStateDir, cacheDir)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	type entry struct {
+		hash string
+		used time.Time
+		size int64
+	}
+	entries := make(map[string]*entry)
+	for _, info := range infos {
+		name := info.Name()
+		ext := filepath.Ext(name)
+		hash := strings.TrimSuffix(name, ext)
+		en, ok := entries[hash]
+		if !ok {
+			en = &entry{hash: hash}
+			entries[hash] = en
+		}
+		en.size += info.Size()
+		// an entry missing standard out is incomplete, and as good as unused
+		if ext == ".out" {
+			en.used = info.ModTime()
+		}
+	}
+
+	sorted := make([]*entry, 0, len(entries))
+	var total int64
+	for _, en := range entries {
+		sorted = append(sorted, en)
+		total += en.size
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].used.Before(sorted[j].used) })
+
+	for _, en := range sorted {
+		if total <= cacheMaxSize && time.Since(en.used) <= cacheMaxAge {
+			break
+		}
+		os.Remove(cachePath(en.hash, "out"))
+		os.Remove(cachePath(en.hash, "err"))
+		total -= en.size
+	}
+}
@@ -0,0 +1,138 @@
+// Scheduling recipes on the critical path first, using how long each target's
+// recipe took in earlier builds.
+
+package main
+
+import (
+	"container/heap"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Targets mapped to how long their recipes last took, in milliseconds.
+var durations = newStateFile("durations", "durations")
+
+// Remember how long a target's recipe took.
+func noteDuration(target string, d time.Duration) {
+	// only whole milliseconds are recorded
+	durations.set(target, strconv.FormatInt(d.Milliseconds(), 10))
+}
+
+// Set each node's priority to the longest total duration of the recipes on a
+// path from it to the root, including its own. Recipes that haven't run before
+// are assumed to take the average time. When shuffling, priorities are random
+// instead.
+func (g *graph) prioritize() {
+	if shuffleRand != nil {
+		// the same seed should give the same priorities
+		names := make([]string, 0, len(g.nodes))
+		for name := range g.nodes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			g.nodes[name].priority = time.Duration(shuffleRand.Int63())
+		}
+		return
+	}
+
+	known := make(map[string]time.Duration)
+	var total time.Duration
+	for target, ms := range durations.all() {
+		if n, err := strconv.ParseInt(ms, 10, 64); err == nil {
+			d := time.Duration(n) * time.Millisecond
+			known[target] = d
+			total += d
+		}
+	}
+
+	average := time.Second
+	if len(known) > 0 {
+		average = total / time.Duration(len(known))
+	}
+
+	// order the nodes so every node follows the ones depending on it
+	order := make([]*node, 0, len(g.nodes))
+	seen := make(map[*node]bool)
+	var visit func(u *node)
+	visit = func(u *node) {
+		seen[u] = true
+		for i := range u.prereqs {
+			if v := u.prereqs[i].v; v != nil && !seen[v] {
+				visit(v)
+			}
+		}
+		order = append(order, u)
+	}
+	visit(g.root)
+
+	for _, u := range order {
+		u.priority = 0
+	}
+	for i := len(order) - 1; i >= 0; i-- {
+		u := order[i]
+		for j := range u.prereqs {
+			v := u.prereqs[j].v
+			if v == nil {
+				continue
+			}
+
+			d, ok := known[v.name]
+			if !ok {
+				d = 0
+				if e := v.ruleEdge(); e != nil && e.r.recipe != "" {
+					d = average
+				}
+			}
+			if u.priority+d > v.priority {
+				v.priority = u.priority + d
+			}
+		}
+	}
+}
+
+// Sort nodes by decreasing priority.
+func sortByPriority(us []*node) {
+	sort.SliceStable(us, func(i, j int) bool {
+		return us[i].priority > us[j].priority
+	})
+}
+
+// A recipe waiting for a subprocess slot.
+type subprocWaiter struct {
+	priority time.Duration // the node's priority
+	seq      int           // order in which recipes started waiting
+	ready    chan bool     // receives once the slot is handed over
+}
+
+// Waiting recipes, highest priority first, or first come first served among
+// equals.
+type subprocQueue []*subprocWaiter
+
+func (q subprocQueue) Len() int { return len(q) }
+
+func (q subprocQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q subprocQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *subprocQueue) Push(x interface{}) { *q = append(*q, x.(*subprocWaiter)) }
+
+func (q *subprocQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return w
+}
+
+// Hand a slot to the highest priority waiting recipe. Called with
+// subprocsRunningCond.L held.
+func wakeSubproc() {
+	w := heap.Pop(&subprocsWaiting).(*subprocWaiter)
+	w.ready <- true
+}
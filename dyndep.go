@@ -0,0 +1,200 @@
+// Dynamic dependencies. A rule with the Y attribute names a dyndep file, which
+// is made before the rule's recipe runs, and lists more prerequisites and
+// outputs of targets, one target per line:
+//
+//	target [outputs...]: prereqs...
+//
+// The graph is extended with them before the target is built.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A line of a dyndep file.
+type dyndepEntry struct {
+	target  string
+	outputs []string // other files the target's recipe makes
+	prereqs []string
+	line    int
+}
+
+// Read a dyndep file.
+func parseDyndep(path string) ([]dyndepEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make([]dyndepEntry, 0)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexRune(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		colon := strings.IndexRune(text, ':')
+		if colon < 0 {
+			return nil, fmt.Errorf("%s:%d: expected 'target [outputs...]: prereqs...'", path, line)
+		}
+		targets := strings.Fields(text[:colon])
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("%s:%d: missing target", path, line)
+		}
+		entries = append(entries, dyndepEntry{
+			target:  targets[0],
+			outputs: targets[1:],
+			prereqs: strings.Fields(text[colon+1:]),
+			line:    line,
+		})
+	}
+	return entries, scanner.Err()
+}
+
+// A recipeless rule standing for a line of a dyndep file.
+func dyndepRule(path string, entry dyndepEntry, targets []string, prereqs []string) *rule {
+	r := &rule{file: path, line: entry.line, prereqs: prereqs}
+	for _, target := range targets {
+		r.targets = append(r.targets, pattern{spat: target})
+	}
+	return r
+}
+
+// Make a node's dyndep file, read it if it hasn't been already, and extend the
+// graph with the node's extra prerequisites, returning them. Called from the
+// node's mkNode.
+func (g *graph) dyndep(u *node, e *edge, dryrun bool) []*node {
+	var dd *node
+	for i := range u.prereqs {
+		if u.prereqs[i].r == e.r && u.prereqs[i].dyndep {
+			dd = u.prereqs[i].v
+		}
+	}
+	if dd == nil {
+		return nil
+	}
+
+	// the file is needed to know what to build, so it's always made
+	mkNodePrereqs(g, u, e, []*node{dd}, dryrun, true)
+	dd.mutex.Lock()
+	failed := dd.status == nodeStatusFailed
+	dd.mutex.Unlock()
+	if failed {
+		return nil
+	}
+
+	g.dyndepLock.Lock()
+	defer g.dyndepLock.Unlock()
+
+	if g.dyndeps == nil {
+		g.dyndeps = make(map[string][]dyndepEntry)
+	}
+	entries, ok := g.dyndeps[dd.name]
+	if !ok {
+		var err error
+		entries, err = parseDyndep(dd.name)
+		if err != nil {
+			// a dry run doesn't make the file
+			if dryrun && os.IsNotExist(err) {
+				return nil
+			}
+			mkError(fmt.Sprintf("mk: %s", err))
+		}
+		g.dyndeps[dd.name] = entries
+		g.dyndepOutputs(dd.name, entries)
+	}
+
+	added := make([]*node, 0)
+	for _, entry := range entries {
+		if entry.target != u.name || len(entry.prereqs) == 0 {
+			continue
+		}
+
+		r := dyndepRule(dd.name, entry, []string{u.name}, entry.prereqs)
+		for _, prereq := range entry.prereqs {
+			v := g.extend(prereq)
+			if g.reaches(v, u) {
+				mkError(fmt.Sprintf("mk: cycle in the graph: %s:%d makes %s depend on %s, which depends on it",
+					dd.name, entry.line, u.name, v.name))
+			}
+			u.newedge(v, r).dynamic = true
+			added = append(added, v)
+		}
+	}
+	insertTurns(added, u)
+	return added
+}
+
+// Make the outputs listed in a dyndep file depend on the targets whose
+// recipes make them, so building an output builds its target. Called with
+// dyndepLock held.
+func (g *graph) dyndepOutputs(path string, entries []dyndepEntry) {
+	for _, entry := range entries {
+		if len(entry.outputs) == 0 {
+			continue
+		}
+		producer := g.extend(entry.target)
+		r := dyndepRule(path, entry, entry.outputs, []string{entry.target})
+		for _, output := range entry.outputs {
+			v := g.extend(output)
+
+			// too late if it's already being built
+			v.mutex.Lock()
+			added := v.status == nodeStatusReady && v != producer
+			if added {
+				v.newedge(producer, r).dynamic = true
+				v.flags |= nodeFlagProbable
+			}
+			v.mutex.Unlock()
+			if added {
+				insertTurns([]*node{producer}, v)
+			}
+		}
+	}
+}
+
+// Return the node for a target, applying rules to add it to the graph if
+// it's not already there. Called with dyndepLock held.
+func (g *graph) extend(target string) *node {
+	g.mutex.Lock()
+	u, ok := g.nodes[target]
+	g.mutex.Unlock()
+	if ok {
+		return u
+	}
+
+	u = applyrules(g.rules, g, target, make([]int, len(g.rules.rules)))
+	g.cyclecheck(u)
+	g.vacuous(u)
+	g.ambiguous(u)
+	return u
+}
+
+// True if v is u, or depends on it.
+func (g *graph) reaches(v *node, u *node) bool {
+	seen := make(map[*node]bool)
+	stack := []*node{v}
+	for len(stack) > 0 {
+		w := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if w == u {
+			return true
+		}
+		for i := range w.prereqs {
+			if x := w.prereqs[i].v; x != nil && !seen[x] {
+				seen[x] = true
+				stack = append(stack, x)
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestParseDyndep(t *testing.T) {
+	tests := []struct {
+		contents string
+		entries  string
+		err      bool
+	}{
+		{"", "", false},
+		{"a.o: a.mod b.mod\n", "a.o [] [a.mod b.mod] 1", false},
+		{"# comment\n\na.o a.mod: b.mod # trailing\n", "a.o [a.mod] [b.mod] 3", false},
+		{"a.o:\nb.o: a.o\n", "a.o [] [] 1; b.o [] [a.o] 2", false},
+		{"a.o b.mod\n", "", true},
+		{": b.mod\n", "", true},
+	}
+	for _, test := range tests {
+		inTempDir(t, map[string]string{"x.dd": test.contents})
+		entries, err := parseDyndep("x.dd")
+		if (err != nil) != test.err {
+			t.Errorf("%q: error %v, want error %v", test.contents, err, test.err)
+			continue
+		}
+		got := make([]string, len(entries))
+		for i, entry := range entries {
+			got[i] = fmt.Sprintf("%s %v %v %d", entry.target, entry.outputs, entry.prereqs, entry.line)
+		}
+		if strings.Join(got, "; ") != test.entries {
+			t.Errorf("%q: entries %q, want %q", test.contents, strings.Join(got, "; "), test.entries)
+		}
+	}
+}
+
+// Edges from a dyndep file are added while building, and dropped on reset so
+// the file is read again.
+func TestDyndepEdges(t *testing.T) {
+	mkfile := "out:Yout.dd: src\n\techo out >> log; touch out\n" +
+		"out.dd: src\n\tcp src out.dd\n" +
+		"%.h:\n\techo $target >> log; touch $target\n"
+	tests := []struct {
+		dyndep string
+		edges  string
+		built  string
+	}{
+		{"out: a.h\n", "src, out.dd (dyndep), a.h (dynamic)", "a.h out"},
+		{"out: b.h c.h\n", "src, out.dd (dyndep), b.h (dynamic), c.h (dynamic)", "b.h c.h out"},
+		{"", "src, out.dd (dyndep)", "out"},
+		// the outputs of other targets depend on them
+		{"out lib.mod:\nother: lib.mod\n", "src, out.dd (dyndep)", "out"},
+	}
+
+	inTempDir(t, nil)
+	var g *graph
+	for _, test := range tests {
+		for _, name := range []string{"out", "out.dd", "log"} {
+			ioutil.WriteFile(name, nil, 0644)
+		}
+		setAge(t, map[string]int{"out": 1, "out.dd": 1})
+		if err := ioutil.WriteFile("src", []byte(test.dyndep), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if g == nil {
+			g = testGraph(t, mkfile, "out")
+		} else {
+			g.reset()
+			for _, u := range g.nodes {
+				if u != g.root {
+					u.updateTimestamp()
+				}
+			}
+		}
+		built := testBuild(t, g)
+
+		if got := edgeNames(g.nodes["out"]); got != test.edges {
+			t.Errorf("%q: edges %q, want %q", test.dyndep, got, test.edges)
+		}
+		if got := strings.Join(built, " "); got != test.built {
+			t.Errorf("%q: built %q, want %q", test.dyndep, got, test.built)
+		}
+	}
+	if got := edgeNames(g.nodes["lib.mod"]); got != "out (dynamic)" {
+		t.Errorf("lib.mod: edges %q, want %q", got, "out (dynamic)")
+	}
+}
+
+// Prerequisites from a dyndep file may come after the target in a
+// deterministic build's order, which mustn't leave them waiting for it.
+func TestDyndepTurns(t *testing.T) {
+	tests := []struct {
+		mkfile string
+		dyndep string
+		order  string // with -deterministic
+		before string // pairs that must be in order when shuffled
+	}{
+		{"all:V: a b\na:Ya.dd:\n\techo a >> log; touch a\nb:\n\techo b >> log; touch b\n",
+			"a: b\n", "b a", "b a"},
+		{"all:V: a b c\na:Ya.dd:\n\techo a >> log; touch a\n" +
+			"b: c\n\techo b >> log; touch b\nc:\n\techo c >> log; touch c\n",
+			"a: b\n", "c b a", "c b b a"},
+		{"all:V: a b\na:Ya.dd:\n\techo a >> log; touch a\nb:\n\techo b >> log; touch b\n" +
+			"%.gen:\n\techo $target >> log; touch $target\n",
+			"a: n.gen b\n", "n.gen b a", "n.gen a b a"},
+	}
+	for _, test := range tests {
+		for _, seed := range []int64{-1, 1, 2, 3} {
+			inTempDir(t, map[string]string{"a.dd": test.dyndep, "a.src": ""})
+			g := testGraph(t, test.mkfile, "all")
+			log := testOrderedBuild(t, g, seed)
+
+			if seed < 0 && test.order != "" && strings.Join(log, " ") != test.order {
+				t.Errorf("%q with %q: built %q, want %q", test.mkfile, test.dyndep,
+					strings.Join(log, " "), test.order)
+			}
+			pos := make(map[string]int)
+			for i, name := range log {
+				pos[name] = i
+			}
+			pairs := strings.Fields(test.before)
+			for i := 0; i+1 < len(pairs); i += 2 {
+				a, ok := pos[pairs[i]]
+				b, okb := pos[pairs[i+1]]
+				if !ok || !okb || a > b {
+					t.Errorf("%q with %q, seed %d: built %q, want %s before %s", test.mkfile,
+						test.dyndep, seed, strings.Join(log, " "), pairs[i], pairs[i+1])
+				}
+			}
+		}
+	}
+}
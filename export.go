@@ -0,0 +1,133 @@
+// Exporting the graph as JSON, for use by other tools. The schema is documented
+// in the README, and changes to it should bump jsonGraphVersion.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"time"
+)
+
+// Version of the schema.
+const jsonGraphVersion = 1
+
+type jsonGraph struct {
+	Version int        `json:"version"`
+	Targets []string   `json:"targets"`
+	Nodes   []jsonNode `json:"nodes"`
+	Rules   []jsonRule `json:"rules"`
+}
+
+type jsonNode struct {
+	Name         string     `json:"name"`
+	Exists       bool       `json:"exists"`
+	Mtime        *string    `json:"mtime"`
+	Virtual      bool       `json:"virtual"`
+	Intermediate bool       `json:"intermediate"`
+	Edges        []jsonEdge `json:"edges"`
+}
+
+type jsonEdge struct {
+	Prereq    *string  `json:"prereq"`
+	Rule      int      `json:"rule"`
+	Stem      *string  `json:"stem"`
+	Matches   []string `json:"matches"`
+	OrderOnly bool     `json:"orderonly"`
+	Optional  bool     `json:"optional"`
+}
+
+type jsonRule struct {
+	Targets    []string `json:"targets"`
+	Prereqs    []string `json:"prereqs"`
+	OrderOnly  []string `json:"orderonly"`
+	Attributes string   `json:"attributes"`
+	Shell      []string `json:"shell"`
+	Command    []string `json:"command"`
+	Meta       bool     `json:"meta"`
+	Recipe     string   `json:"recipe"`
+	File       string   `json:"file"`
+	Line       int      `json:"line"`
+}
+
+// Write every node in the graph, other than the dummy root, as JSON.
+func (g *graph) exportJSON(w io.Writer) error {
+	out := jsonGraph{Version: jsonGraphVersion}
+	out.Targets = make([]string, 0)
+	out.Nodes = make([]jsonNode, 0, len(g.nodes))
+	out.Rules = make([]jsonRule, 0)
+	for i := range g.root.prereqs {
+		if g.root.prereqs[i].v != nil {
+			out.Targets = append(out.Targets, g.root.prereqs[i].v.name)
+		}
+	}
+
+	names := make([]string, 0, len(g.nodes))
+	for name := range g.nodes {
+		if g.nodes[name] != g.root {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	ruleidx := make(map[*rule]int)
+	for _, name := range names {
+		u := g.nodes[name]
+		n := jsonNode{Name: u.name, Exists: u.exists, Virtual: u.virtual(),
+			Intermediate: u.flags&nodeFlagIntermediate != 0}
+		if u.exists {
+			mtime := u.t.Format(time.RFC3339Nano)
+			n.Mtime = &mtime
+		}
+
+		n.Edges = make([]jsonEdge, 0, len(u.prereqs))
+		for i := range u.prereqs {
+			e := u.prereqs[i]
+			k, ok := ruleidx[e.r]
+			if !ok {
+				k = len(out.Rules)
+				ruleidx[e.r] = k
+				out.Rules = append(out.Rules, jsonRuleFor(e.r))
+			}
+
+			je := jsonEdge{Rule: k, Matches: e.matches, OrderOnly: e.orderonly,
+				Optional: e.optional}
+			if e.v != nil {
+				je.Prereq = &e.v.name
+			}
+			if e.r.ismeta && !e.r.attributes.regex {
+				stem := e.stem
+				je.Stem = &stem
+			}
+			if je.Matches == nil {
+				je.Matches = []string{}
+			}
+			n.Edges = append(n.Edges, je)
+		}
+		out.Nodes = append(out.Nodes, n)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+func jsonRuleFor(r *rule) jsonRule {
+	jr := jsonRule{
+		Targets:    make([]string, len(r.targets)),
+		Prereqs:    append([]string{}, r.prereqs...),
+		OrderOnly:  append([]string{}, r.orderonly...),
+		Attributes: r.attributes.letters(),
+		Shell:      append([]string{}, r.shell...),
+		Command:    append([]string{}, r.command...),
+		Meta:       r.ismeta,
+		Recipe:     r.recipe,
+		File:       r.file,
+		Line:       r.line,
+	}
+	for i := range r.targets {
+		jr.Targets[i] = r.targets[i].spat
+	}
+	return jr
+}
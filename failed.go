@@ -0,0 +1,37 @@
+// Remembering which targets failed to build, so they can be retried.
+
+package main
+
+import (
+	"sort"
+)
+
+// True if targets that failed before with identical inputs should be skipped.
+var skipfailed bool = false
+
+// Targets that failed, mapped to a hash of the inputs they failed with.
+var failedTargets = newStateFile("failed", "failed targets")
+
+// Return the targets that failed in earlier builds, in sorted order.
+func failedTargetNames() []string {
+	targets := make([]string, 0)
+	for target := range failedTargets.all() {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// Return the hash of the inputs a target last failed with, if it failed.
+func failedHash(target string) (string, bool) {
+	return failedTargets.get(target)
+}
+
+// Note whether a recipe succeeded, remembering the inputs if it failed.
+func noteFailure(u *node, program string, args []string, recipe string, success bool) {
+	if success {
+		failedTargets.remove(u.name)
+	} else {
+		failedTargets.set(u.name, hashInputs(u, program, args, recipe))
+	}
+}
@@ -0,0 +1,156 @@
+// Glob patterns in prerequisites and assignments, expanded against the
+// filesystem.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// True if a word, as written, has glob characters outside of quotes,
+// backticks, and variable expansions.
+func hasGlob(input string) bool {
+	for i := 0; i < len(input); {
+		c, w := utf8.DecodeRuneInString(input[i:])
+		i += w
+		switch c {
+		case '*', '?', '[':
+			return true
+		case '\\':
+			_, w = utf8.DecodeRuneInString(input[i:])
+			i += w
+		case '\'', '"', '`':
+			j := strings.IndexRune(input[i:], c)
+			if j < 0 {
+				return false
+			}
+			i += j + 1
+		case '$':
+			if strings.HasPrefix(input[i:], "{") {
+				j := strings.IndexRune(input[i:], '}')
+				if j < 0 {
+					return false
+				}
+				i += j + 1
+			}
+		}
+	}
+	return false
+}
+
+// Expand the glob patterns in words from a mkfile in the given directory.
+// Words that are still meta-rule patterns, containing '%' or a '$', are left
+// alone, and as in rc, a pattern matching nothing is left as it is, since it
+// may name a file that's yet to be made.
+func expandGlobs(words []string, dir string) []string {
+	// matches are named relative to the current directory, where recipes run
+	prefix := ""
+	if cwd, err := os.Getwd(); err != nil || cwd != dir {
+		prefix = dir
+		if rel, err := filepath.Rel(cwd, dir); err == nil {
+			prefix = rel
+		}
+	}
+
+	expanded := make([]string, 0, len(words))
+	for _, word := range words {
+		if strings.ContainsAny(word, "%$") {
+			expanded = append(expanded, word)
+			continue
+		}
+
+		matches := glob(word, dir)
+		if len(matches) == 0 {
+			expanded = append(expanded, word)
+			continue
+		}
+		for _, match := range matches {
+			if prefix != "" && !filepath.IsAbs(match) {
+				match = filepath.Join(prefix, match)
+			}
+			expanded = append(expanded, match)
+		}
+	}
+	return expanded
+}
+
+// Match a glob pattern, which may use '**' to match any number of
+// directories, returning matches in sorted order. Relative patterns are
+// matched in the given directory.
+func glob(pattern string, dir string) []string {
+	base, rel := dir, ""
+	if filepath.IsAbs(pattern) {
+		base, rel = "/", "/"
+	}
+
+	matches := make([]string, 0)
+	globSegments(base, rel, strings.Split(strings.TrimLeft(pattern, "/"), "/"), &matches)
+	sort.Strings(matches)
+
+	// '**' can reach the same file more than one way
+	unique := matches[:0]
+	for i := range matches {
+		if i == 0 || matches[i] != matches[i-1] {
+			unique = append(unique, matches[i])
+		}
+	}
+	return unique
+}
+
+// Match the remaining segments of a pattern below rel, a path relative to
+// base, appending matches to out.
+func globSegments(base string, rel string, segs []string, out *[]string) {
+	if len(segs) == 0 {
+		*out = append(*out, rel)
+		return
+	}
+	seg := segs[0]
+
+	if seg == "**" {
+		globSegments(base, rel, segs[1:], out)
+
+		// symlinks aren't followed, so loops can't recur forever
+		entries, _ := ioutil.ReadDir(filepath.Join(base, rel))
+		for _, entry := range entries {
+			if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+				globSegments(base, filepath.Join(rel, entry.Name()), segs, out)
+			}
+		}
+		return
+	}
+
+	if !strings.ContainsAny(seg, "*?[\\") {
+		path := filepath.Join(rel, seg)
+		if _, err := os.Stat(filepath.Join(base, path)); err == nil {
+			globSegments(base, path, segs[1:], out)
+		}
+		return
+	}
+
+	entries, _ := ioutil.ReadDir(filepath.Join(base, rel))
+	for _, entry := range entries {
+		name := entry.Name()
+
+		// as in the shell, hidden files must be matched explicitly
+		if strings.HasPrefix(name, ".") && !strings.HasPrefix(seg, ".") {
+			continue
+		}
+		if ok, _ := filepath.Match(seg, name); !ok {
+			continue
+		}
+
+		path := filepath.Join(rel, name)
+		if len(segs) > 1 {
+			info, err := os.Stat(filepath.Join(base, path))
+			if err != nil || !info.IsDir() {
+				continue
+			}
+		}
+		globSegments(base, path, segs[1:], out)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandGlobs(t *testing.T) {
+	files := map[string]string{
+		"a.c": "", "b.c": "", "c.h": "", ".hidden.c": "",
+		"sub/d.c": "", "sub/deep/e.c": "",
+	}
+	tests := []struct {
+		mkfile  string
+		targets string
+		prereqs string
+	}{
+		{"prog: *.c\n\tcc $prereq\n", "prog", "a.c b.c"},
+		{"prog: ./?.[ch]\n\tcc $prereq\n", "prog", "a.c b.c c.h"},
+		{"prog: ?[ab].c\n\tcc $prereq\n", "prog", "?a.c ?b.c"},
+		{"prog: **/*.c\n\tcc $prereq\n", "prog", "a.c b.c sub/d.c sub/deep/e.c"},
+		{"prog: .*.c\n\tcc $prereq\n", "prog", ".hidden.c"},
+		// a pattern matching nothing may name a file that's yet to be made
+		{"prog: *.y\n\tcc $prereq\n", "prog", "*.y"},
+		{"prog: 'a*.c'\n\tcc $prereq\n", "prog", "a*.c"},
+		// targets aren't globbed
+		{"*.c: c.h\n\ttouch $target\n", "*.c", "c.h"},
+		// meta-rule patterns are left alone
+		{"%.o: *%.c\n\tcc $prereq\n", "%.o", "*%.c"},
+		{"(.*)\\.[ch]:R: $stem1.y\n\tyacc $prereq\n", "^(.*)\\.[ch]$", "$stem1.y"},
+	}
+	for _, test := range tests {
+		inTempDir(t, files)
+		rs := testRules(t, test.mkfile)
+		r := rs.rules[0]
+		targets := make([]string, len(r.targets))
+		for i := range r.targets {
+			targets[i] = r.targets[i].spat
+			if r.attributes.regex {
+				targets[i] = r.targets[i].rpat.String()
+			}
+		}
+		if got := strings.Join(targets, " "); got != test.targets {
+			t.Errorf("%q: targets %q, want %q", test.mkfile, got, test.targets)
+		}
+		if got := strings.Join(r.prereqs, " "); got != test.prereqs {
+			t.Errorf("%q: prereqs %q, want %q", test.mkfile, got, test.prereqs)
+		}
+	}
+}
+
+func TestAssignmentGlobs(t *testing.T) {
+	files := map[string]string{"a.c": "", "b.c": "", "src/c.c": "", "src/sub/d.c": ""}
+	tests := []struct {
+		mkfile  string
+		srcs    string
+		prereqs string
+	}{
+		{"SRCS=*.c\nprog: $SRCS\n", "a.c b.c", "a.c b.c"},
+		{"SRCS=src/**/*.c\nprog: ${SRCS:%.c=%.o}\n", "src/c.c src/sub/d.c", "src/c.o src/sub/d.o"},
+		{"SRCS=*.y\nprog: $SRCS\n", "*.y", "*.y"},
+		// glob characters from a variable's value are left alone
+		{"SRCS='*.c'\nprog: $SRCS\n", "*.c", "*.c"},
+		{"PAT='*.c'\nSRCS=$PAT b*\nprog: $SRCS\n", "*.c b.c", "*.c b.c"},
+	}
+	for _, test := range tests {
+		inTempDir(t, files)
+		rs := testRules(t, test.mkfile)
+		if got := strings.Join(rs.vars["SRCS"], " "); got != test.srcs {
+			t.Errorf("%q: SRCS = %q, want %q", test.mkfile, got, test.srcs)
+		}
+		if got := strings.Join(rs.rules[0].prereqs, " "); got != test.prereqs {
+			t.Errorf("%q: prereqs %q, want %q", test.mkfile, got, test.prereqs)
+		}
+	}
+}
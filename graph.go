@@ -4,7 +4,11 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,6 +16,18 @@ import (
 type graph struct {
 	root  *node            // the intial target's node
 	nodes map[string]*node // map targets to their nodes
+	meta  *metaIndex       // meta-rules that may match a target
+	mutex sync.Mutex       // exclusivity for nodes while building the graph
+	rules *ruleSet         // rules the graph was built from
+
+	// prerequisites may be matched to rules concurrently, since application
+	// limits can't affect which rules apply
+	parallel bool
+
+	scan *includeScanner // files looked at for #include directives
+
+	dyndeps    map[string][]dyndepEntry // dyndep files read so far
+	dyndepLock sync.Mutex               // exclusivity for extending the graph mid-build
 }
 
 // An edge in the graph.
@@ -20,7 +36,27 @@ type edge struct {
 	stem    string   // stem matched for meta-rule applications
 	matches []string // regular expression matches
 	togo    bool     // this edge is going to be pruned
+	reason  string   // why the edge was pruned
 	r       *rule
+
+	orderonly bool // only the prerequisite's existence matters, not its timestamp
+	optional  bool // dropped if the prerequisite doesn't exist and can't be made
+	dyndep    bool // leads to the rule's dyndep file
+	dynamic   bool // added from a dyndep file during the build
+}
+
+// Set the kind of an edge for the i'th of a rule's prerequisites, as listed by
+// allPrereqs.
+func (e *edge) setKind(r *rule, i int, optional bool) {
+	e.optional = optional
+	if i >= len(r.prereqs)+len(r.orderonly) {
+		// the dyndep file is read before the recipe runs, but it changing
+		// doesn't itself make the target out of date
+		e.dyndep = true
+		e.orderonly = true
+	} else if i >= len(r.prereqs) {
+		e.orderonly = true
+	}
 }
 
 // Current status of a node in the build.
@@ -37,31 +73,41 @@ const (
 type nodeFlag int
 
 const (
-	nodeFlagCycle    nodeFlag = 0x0002
-	nodeFlagReady             = 0x0004
-	nodeFlagProbable          = 0x0100
-	nodeFlagVacuous           = 0x0200
+	nodeFlagReady        nodeFlag = 0x0004
+	nodeFlagProbable              = 0x0100
+	nodeFlagVacuous               = 0x0200
+	nodeFlagUnambiguous           = 0x0400
+	nodeFlagIntermediate          = 0x0800
+	nodeFlagCreated               = 0x1000
+	nodeFlagMissing               = 0x2000
 )
 
 // A node in the dependency graph
 type node struct {
-	r         *rule             // rule to be applied
-	name      string            // target name
-	prog      string            // custom program to compare times
-	t         time.Time         // file modification time
-	exists    bool              // does a non-virtual target exist
-	prereqs   []*edge           // prerequisite rules
-	status    nodeStatus        // current state of the node in the build
-	mutex     sync.Mutex        // exclusivity for the status variable
-	listeners []chan nodeStatus // channels to notify of completion
-	flags     nodeFlag          // bitwise combination of node flags
+	r          *rule             // rule to be applied
+	name       string            // target name
+	prog       string            // custom program to compare times
+	t          time.Time         // file modification time
+	exists     bool              // does a non-virtual target exist
+	prereqs    []*edge           // prerequisite rules
+	status     nodeStatus        // current state of the node in the build
+	mutex      sync.Mutex        // exclusivity for the status variable
+	listeners  []chan nodeStatus // channels to notify of completion
+	flags      nodeFlag          // bitwise combination of node flags
+	pruned     []*edge           // edges removed from prereqs
+	ambiguous  []*rule           // rules with conflicting recipes, if keepambiguous
+	priority   time.Duration     // longest time from starting this recipe to finishing the root's
+	hasTurn    bool              // takes a turn in a deterministic build
+	prevTurn   *node             // node whose turn comes just before, or nil if first
+	nextTurn   *node             // node whose turn comes just after, or nil if last
+	turnPassed bool              // the next node has been let take its turn
 }
 
 // Update a node's timestamp and 'exists' flag.
 func (u *node) updateTimestamp() {
 	info, err := os.Stat(u.name)
 	if err == nil {
-		u.t = info.ModTime()
+		u.t = restatModTime(u.name, info.ModTime())
 		u.exists = true
 		u.flags |= nodeFlagProbable
 	} else {
@@ -74,27 +120,180 @@ func (u *node) updateTimestamp() {
 		}
 	}
 
-	if rebuildall {
-		u.flags |= nodeFlagProbable
+}
+
+// Return the node for a target, creating it if needed. Returns true if the
+// node was created, in which case the caller is responsible for its edges.
+func (g *graph) getnode(name string) (*node, bool) {
+	g.mutex.Lock()
+	u, ok := g.nodes[name]
+	if !ok {
+		u = &node{name: name}
+		g.nodes[name] = u
 	}
+	g.mutex.Unlock()
+
+	if !ok {
+		u.updateTimestamp()
+	}
+	return u, !ok
 }
 
-// Create a new node
-func (g *graph) newnode(name string) *node {
-	u := &node{name: name}
-	u.updateTimestamp()
-	g.nodes[name] = u
-	return u
+// Reset the status of every node, so the graph can be built again.
+func (g *graph) reset() {
+	for _, u := range g.nodes {
+		// the last build's goroutines may still be letting go of the node
+		u.mutex.Lock()
+		u.status = nodeStatusReady
+		u.listeners = u.listeners[0:0]
+		u.mutex.Unlock()
+		u.flags &^= nodeFlagCreated
+
+		// dyndep files are read again, since they may have changed
+		prereqs := u.prereqs[:0]
+		for _, e := range u.prereqs {
+			if !e.dynamic {
+				prereqs = append(prereqs, e)
+			}
+		}
+		u.prereqs = prereqs
+	}
+	g.dyndeps = nil
+
+	// recipes may have taken longer or shorter this time
+	g.prioritize()
+}
+
+// Return the edge whose rule is used to build a node, preferring one with a
+// recipe over those that only add prerequisites, or nil if there is none.
+func (u *node) ruleEdge() *edge {
+	var e *edge = nil
+	for i := range u.prereqs {
+		f := u.prereqs[i]
+		if f.r != nil && (e == nil || f.r.recipe != "" || e.r.recipe == "") {
+			e = f
+		}
+	}
+	return e
+}
+
+// True if a node is the target of a virtual rule.
+func (u *node) virtual() bool {
+	for i := range u.prereqs {
+		if u.prereqs[i].r != nil && u.prereqs[i].r.attributes.virtual {
+			return true
+		}
+	}
+	return false
 }
 
-// Print a graph in graphviz format.
+// Whether a node is up to date, judged without building anything.
+type nodeFreshness int
+
+const (
+	nodeUpToDate nodeFreshness = iota
+	nodeOutOfDate
+	nodeMissing
+)
+
+// Determine the freshness of u, and every node it depends on.
+func (g *graph) freshness(u *node, fresh map[*node]nodeFreshness) nodeFreshness {
+	if f, ok := fresh[u]; ok {
+		return f
+	}
+
+	f := nodeUpToDate
+	if u.virtual() {
+		e := u.ruleEdge()
+		if e != nil && e.r.recipe != "" {
+			f = nodeOutOfDate
+		}
+	} else if !u.exists {
+		f = nodeMissing
+		if len(u.prereqs) > 0 {
+			f = nodeOutOfDate
+		}
+	}
+
+	for i := range u.prereqs {
+		v := u.prereqs[i].v
+		if v == nil || u.prereqs[i].orderonly {
+			continue
+		}
+		if g.freshness(v, fresh) != nodeUpToDate || (!v.virtual() && u.t.Before(v.t)) {
+			if f == nodeUpToDate {
+				f = nodeOutOfDate
+			}
+		}
+	}
+
+	fresh[u] = f
+	return f
+}
+
+// Quote a string for graphviz.
+func dotQuote(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\n", "\\n", -1)
+	return "\"" + strings.Replace(s, "\"", "\\\"", -1) + "\""
+}
+
+// Print the graph for the requested targets in graphviz format. Edges are
+// labeled with the rule that created them, virtual targets are drawn as boxes,
+// and nodes are colored by whether they are up to date, out of date, or
+// missing.
 func (g *graph) visualize(w io.Writer) {
-	fmt.Fprintln(w, "digraph mk {")
-	for t, u := range g.nodes {
+	colors := map[nodeFreshness]string{
+		nodeUpToDate:  "palegreen",
+		nodeOutOfDate: "gold",
+		nodeMissing:   "lightcoral",
+	}
+
+	fresh := make(map[*node]nodeFreshness)
+	seen := make(map[*node]bool)
+	var visit func(u *node)
+	visit = func(u *node) {
+		if seen[u] {
+			return
+		}
+		seen[u] = true
+
+		style := "filled"
+		shape := "ellipse"
+		if u.virtual() {
+			style = "filled,dashed"
+			shape = "box"
+		}
+		fmt.Fprintf(w, "    %s [shape=%s, style=\"%s\", fillcolor=%s];\n",
+			dotQuote(u.name), shape, style, colors[g.freshness(u, fresh)])
+
 		for i := range u.prereqs {
-			if u.prereqs[i].v != nil {
-				fmt.Fprintf(w, "    \"%s\" -> \"%s\";\n", t, u.prereqs[i].v.name)
+			e := u.prereqs[i]
+			if e.v == nil {
+				continue
+			}
+			label := fmt.Sprintf("%s:%d", e.r.file, e.r.line)
+			if e.r.attributes.regex {
+				for j := 1; j < len(e.matches); j++ {
+					label += fmt.Sprintf("\nstem%d=%s", j, e.matches[j])
+				}
+			} else if e.r.ismeta {
+				label += fmt.Sprintf("\nstem=%s", e.stem)
+			}
+			style := "solid"
+			if e.orderonly {
+				style = "dashed"
 			}
+			fmt.Fprintf(w, "    %s -> %s [label=%s, style=%s];\n",
+				dotQuote(u.name), dotQuote(e.v.name), dotQuote(label), style)
+			visit(e.v)
+		}
+	}
+
+	fmt.Fprintln(w, "digraph mk {")
+	for i := range g.root.prereqs {
+		if g.root.prereqs[i].v != nil {
+			visit(g.root.prereqs[i].v)
 		}
 	}
 	fmt.Fprintln(w, "}")
@@ -109,7 +308,9 @@ func (u *node) newedge(v *node, r *rule) *edge {
 
 // Create a dependency graph for the given target.
 func buildgraph(rs *ruleSet, target string) *graph {
-	g := &graph{nil, make(map[string]*node)}
+	g := &graph{nodes: make(map[string]*node), meta: rs.indexMeta(), rules: rs,
+		scan: newIncludeScanner()}
+	g.parallel = concurrentPrereqs && !rs.chainsRecur(g.meta)
 
 	// keep track of how many times each rule is visited, to avoid cycles.
 	rulecnt := make([]int, len(rs.rules))
@@ -118,6 +319,8 @@ func buildgraph(rs *ruleSet, target string) *graph {
 	g.root.flags |= nodeFlagProbable
 	g.vacuous(g.root)
 	g.ambiguous(g.root)
+	g.markIntermediates(rs)
+	g.prioritize()
 
 	return g
 }
@@ -125,11 +328,10 @@ func buildgraph(rs *ruleSet, target string) *graph {
 // Recursively match the given target to a rule in the rule set to construct the
 // full graph.
 func applyrules(rs *ruleSet, g *graph, target string, rulecnt []int) *node {
-	u, ok := g.nodes[target]
-	if ok {
+	u, created := g.getnode(target)
+	if !created {
 		return u
 	}
-	u = g.newnode(target)
 
 	// does the target match a concrete rule?
 
@@ -137,29 +339,35 @@ func applyrules(rs *ruleSet, g *graph, target string, rulecnt []int) *node {
 	if ok {
 		for ki := range ks {
 			k := ks[ki]
-			if rulecnt[k] > maxRuleCnt {
+			r := &rs.rules[k]
+			if rulecnt[k] > r.maxApplications() {
 				continue
 			}
 
-			r := &rs.rules[k]
-
 			// skip meta-rules
 			if r.ismeta {
 				continue
 			}
 
 			// skip rules that have no effect
-			if r.recipe == "" && len(r.prereqs) == 0 {
+			prereqs := r.allPrereqs()
+			if r.recipe == "" && len(prereqs) == 0 {
 				continue
 			}
 
 			u.flags |= nodeFlagProbable
 			rulecnt[k] += 1
-			if len(r.prereqs) == 0 {
+			if len(prereqs) == 0 {
 				u.newedge(nil, r)
 			} else {
-				for i := range r.prereqs {
-					u.newedge(applyrules(rs, g, r.prereqs[i], rulecnt), r)
+				optional := stripOptional(prereqs)
+				vs := applyprereqs(rs, g, prereqs, rulecnt)
+				for i := range vs {
+					e := u.newedge(vs[i], r)
+					e.setKind(r, i, optional[i])
+				}
+				if r.attributes.scanIncludes {
+					g.addHeaderEdges(rs, u, r, prereqs[:len(r.prereqs)], rulecnt)
 				}
 			}
 			rulecnt[k] -= 1
@@ -167,68 +375,126 @@ func applyrules(rs *ruleSet, g *graph, target string, rulecnt []int) *node {
 	}
 
 	// find applicable metarules
-	for k := range rs.rules {
-		if rulecnt[k] >= maxRuleCnt {
-			continue
-		}
-
+	for _, c := range g.meta.candidates(target) {
+		k := c.rule
 		r := &rs.rules[k]
-
-		if !r.ismeta {
+		if rulecnt[k] >= r.maxApplications() {
 			continue
 		}
 
-		// skip rules that have no effect
-		if r.recipe == "" && len(r.prereqs) == 0 {
+		mat := r.targets[c.target].match(target)
+		if mat == nil {
 			continue
 		}
 
-		for j := range r.targets {
-			mat := r.targets[j].match(target)
-			if mat == nil {
-				continue
-			}
+		var stem string
+		var matches []string
+		var match_vars = make(map[string][]string)
 
-			var stem string
-			var matches []string
-			var match_vars = make(map[string][]string)
+		if r.attributes.regex {
+			matches = mat
+			for i := range matches {
+				key := fmt.Sprintf("stem%d", i)
+				match_vars[key] = matches[i : i+1]
+			}
+		} else {
+			stem = mat[1]
+		}
 
-			if r.attributes.regex {
-				matches = mat
-				for i := range matches {
-					key := fmt.Sprintf("stem%d", i)
-					match_vars[key] = matches[i : i+1]
+		rulecnt[k] += 1
+		prereqs := r.allPrereqs()
+		if len(prereqs) == 0 {
+			e := u.newedge(nil, r)
+			e.stem = stem
+			e.matches = matches
+		} else {
+			for i := range prereqs {
+				if r.attributes.regex {
+					prereqs[i] = expandRecipeSigils(prereqs[i], match_vars)
+				} else {
+					prereqs[i] = expandSuffixes(prereqs[i], stem)
 				}
-			} else {
-				stem = mat[1]
 			}
 
-			rulecnt[k] += 1
-			if len(r.prereqs) == 0 {
-				e := u.newedge(nil, r)
+			optional := stripOptional(prereqs)
+			vs := applyprereqs(rs, g, prereqs, rulecnt)
+			for i := range vs {
+				e := u.newedge(vs[i], r)
 				e.stem = stem
 				e.matches = matches
-			} else {
-				for i := range r.prereqs {
-					var prereq string
-					if r.attributes.regex {
-						prereq = expandRecipeSigils(r.prereqs[i], match_vars)
-					} else {
-						prereq = expandSuffixes(r.prereqs[i], stem)
-					}
-
-					e := u.newedge(applyrules(rs, g, prereq, rulecnt), r)
-					e.stem = stem
-					e.matches = matches
-				}
+				e.setKind(r, i, optional[i])
+			}
+			if r.attributes.scanIncludes {
+				g.addHeaderEdges(rs, u, r, prereqs[:len(r.prereqs)], rulecnt)
 			}
-			rulecnt[k] -= 1
 		}
+		rulecnt[k] -= 1
 	}
 
 	return u
 }
 
+// Rules with at least this many prerequisites have them matched concurrently.
+const parallelPrereqs = 64
+
+// True if long lists of prerequisites may be matched concurrently. Only how
+// fast graphs are built depends on it.
+var concurrentPrereqs bool = true
+
+// Apply rules to each of a rule's prerequisites, returning their nodes.
+//
+// Long lists of prerequisites are split among several goroutines, each with
+// its own copy of the rule counts. Since nodes are shared, which path first
+// reaches a node can vary, which would matter if a rule's application limit
+// could be reached along one path but not another, so when chains of rules
+// could recur, prerequisites are matched one at a time.
+func applyprereqs(rs *ruleSet, g *graph, prereqs []string, rulecnt []int) []*node {
+	vs := make([]*node, len(prereqs))
+	if len(prereqs) < parallelPrereqs || !g.parallel {
+		for i := range prereqs {
+			vs[i] = applyrules(rs, g, prereqs[i], rulecnt)
+		}
+		return vs
+	}
+
+	// errors are raised again here, where a server can recover from them
+	workers := runtime.GOMAXPROCS(0)
+	failures := make(chan interface{}, workers)
+	var failed int32
+
+	var wg sync.WaitGroup
+	next := int64(-1)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					atomic.StoreInt32(&failed, 1)
+					failures <- r
+				}
+			}()
+
+			cnt := append([]int(nil), rulecnt...)
+			for atomic.LoadInt32(&failed) == 0 {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(prereqs) {
+					break
+				}
+				vs[i] = applyrules(rs, g, prereqs[i], cnt)
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case r := <-failures:
+		panic(r)
+	default:
+	}
+	return vs
+}
+
 // Remove edges marked as togo.
 func (g *graph) togo(u *node) {
 	n := 0
@@ -243,6 +509,8 @@ func (g *graph) togo(u *node) {
 		if !u.prereqs[i].togo {
 			prereqs[j] = u.prereqs[i]
 			j++
+		} else {
+			u.pruned = append(u.pruned, u.prereqs[i])
 		}
 	}
 
@@ -252,32 +520,79 @@ func (g *graph) togo(u *node) {
 }
 
 // Remove vacous children of n.
+//
+// With -a every node is probable, so nothing is vacuous, but whether an
+// optional prerequisite can be made mustn't depend on that, so nodes that
+// can't be made regardless are flagged nodeFlagMissing.
 func (g *graph) vacuous(u *node) bool {
-	vac := u.flags&nodeFlagProbable == 0
+	vac := u.flags&nodeFlagProbable == 0 && !rebuildall
 	if u.flags&nodeFlagReady != 0 {
 		return vac
 	}
 	u.flags |= nodeFlagReady
+	unmakeable := u.flags&nodeFlagProbable == 0
 
+	missing := make(map[*rule]bool) // rules with only missing optional prereqs
 	for i := range u.prereqs {
 		e := u.prereqs[i]
-		if e.v != nil && g.vacuous(e.v) && e.r.ismeta {
+		if e.r.scanned != nil {
+			// kept or not along with the rule that was scanned
+			g.vacuous(e.v)
+			continue
+		} else if e.optional && g.missing(e.v) {
+			e.togo = true
+			e.reason = fmt.Sprintf("optional prerequisite %s doesn't exist", e.v.name)
+			if _, ok := missing[e.r]; !ok {
+				missing[e.r] = true
+			}
+		} else if e.v != nil && g.vacuous(e.v) && e.r.ismeta {
 			e.togo = true
+			e.reason = fmt.Sprintf("%s doesn't exist and nothing can make it", e.v.name)
+			missing[e.r] = false
 		} else {
 			vac = false
+			missing[e.r] = false
+			if e.v == nil || !g.missing(e.v) {
+				unmakeable = false
+			}
 		}
 	}
 
-	// if a rule generated edges that are not togo, keep all of its edges
+	// if a rule generated edges that are not togo, keep all of its edges, other
+	// than missing optional prerequisites
+	keep := make(map[*rule]bool)
+	for i := range u.prereqs {
+		if !u.prereqs[i].togo && u.prereqs[i].r.scanned == nil {
+			keep[u.prereqs[i].r] = true
+		}
+	}
 	for i := range u.prereqs {
 		e := u.prereqs[i]
-		if !e.togo {
-			for j := range u.prereqs {
-				f := u.prereqs[j]
-				if e.r == f.r {
-					f.togo = false
-				}
+		if keep[e.r] && !(e.optional && e.v.flags&nodeFlagMissing != 0) {
+			e.togo = false
+		}
+		if e.r.scanned != nil && !keep[e.r.scanned] {
+			e.togo = true
+			e.reason = fmt.Sprintf("headers scanned for the rule at %s:%d, which doesn't apply",
+				e.r.file, e.r.line)
+		}
+	}
+
+	// an explicit rule whose prerequisites are all optional and missing still
+	// applies, but a meta-rule left with nothing to make the target from
+	// doesn't
+	for i := range u.prereqs {
+		e := u.prereqs[i]
+		if missing[e.r] {
+			missing[e.r] = false
+			if e.r.ismeta {
+				continue
 			}
+			f := u.newedge(nil, e.r)
+			f.stem = e.stem
+			f.matches = e.matches
+			vac = false
+			unmakeable = false
 		}
 	}
 
@@ -285,87 +600,322 @@ func (g *graph) vacuous(u *node) bool {
 	if vac {
 		u.flags |= nodeFlagVacuous
 	}
+	if unmakeable {
+		u.flags |= nodeFlagMissing
+	}
 
 	return vac
 }
 
-// Check for cycles
-func (g *graph) cyclecheck(u *node) {
-	if u.flags&nodeFlagCycle != 0 && len(u.prereqs) > 0 {
-		mkError(fmt.Sprintf("cycle in the graph detected at target %s", u.name))
+// True if a node doesn't exist and can't be made, even with -a.
+func (g *graph) missing(u *node) bool {
+	g.vacuous(u)
+	return u.flags&nodeFlagMissing != 0
+}
+
+// Flag the nodes made only as steps in chains of meta-rules: those that aren't
+// requested, aren't the target of an explicit rule or a K rule, aren't dyndep
+// files, and are only prerequisites of meta-rules.
+func (g *graph) markIntermediates(rs *ruleSet) {
+	mentioned := make(map[*node]bool)
+	for i := range g.root.prereqs {
+		if v := g.root.prereqs[i].v; v != nil {
+			mentioned[v] = true
+		}
 	}
-	u.flags |= nodeFlagCycle
-	for i := range u.prereqs {
-		if u.prereqs[i].v != nil {
-			g.cyclecheck(u.prereqs[i].v)
+	for _, u := range g.nodes {
+		for i := range u.prereqs {
+			e := u.prereqs[i]
+			if e.v != nil && (!e.r.ismeta || e.dyndep) {
+				mentioned[e.v] = true
+			}
 		}
 	}
-	u.flags &= ^nodeFlagCycle
 
+	for _, u := range g.nodes {
+		e := u.ruleEdge()
+		if e == nil || !e.r.ismeta || e.r.attributes.keep || e.r.attributes.virtual {
+			continue
+		}
+		if _, explicit := rs.targetrules[u.name]; !explicit && !mentioned[u] {
+			u.flags |= nodeFlagIntermediate
+		}
+	}
 }
 
-// Deal with ambiguous rules.
-func (g *graph) ambiguous(u *node) {
-	bad := 0
-	var le *edge
-	for i := range u.prereqs {
-		e := u.prereqs[i]
-
-		if e.v != nil {
-			g.ambiguous(e.v)
+// Remove the intermediate files that didn't exist until their recipes ran in
+// this build, unless the build failed. Files that were already there are left
+// alone, since they may have been edited by hand.
+func (g *graph) removeIntermediates() {
+	names := make([]string, 0)
+	for name, u := range g.nodes {
+		if u.status == nodeStatusFailed {
+			return
 		}
-		if e.r.recipe == "" {
+		if u.flags&nodeFlagIntermediate != 0 && u.flags&nodeFlagCreated != 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, err := os.Stat(name); err != nil {
 			continue
 		}
-		if le == nil || le.r == nil {
-			le = e
-		} else {
-			if !le.r.equivRecipe(e.r) {
-				if le.r.ismeta && !e.r.ismeta {
-					mkPrintRecipe(u.name, le.r.recipe, false)
-					le.togo = true
-					le = e
-				} else if !le.r.ismeta && e.r.ismeta {
-					mkPrintRecipe(u.name, e.r.recipe, false)
-					e.togo = true
-					continue
+		mkPrintMessage(fmt.Sprintf("mk: removing intermediate %s", name))
+		if err := os.Remove(name); err != nil {
+			mkPrintError(fmt.Sprintf("mk: %s", err))
+		}
+	}
+}
+
+// Most cycles reported at once, since a tangled graph can have exponentially
+// many.
+const maxCycles = 100
+
+// Check for cycles, reporting every distinct one, up to maxCycles, with the
+// rules creating its edges.
+func (g *graph) cyclecheck(u *node) {
+	msg := ""
+	count := 0
+	for _, scc := range stronglyConnected(u) {
+		if count == maxCycles {
+			break
+		}
+		msg += cyclesIn(scc, &count)
+	}
+	if count == maxCycles {
+		msg += fmt.Sprintf("mk: only the first %d cycles are shown\n", maxCycles)
+	}
+	if msg != "" {
+		mkError(strings.TrimSuffix(msg, "\n"))
+	}
+}
+
+// Return the strongly connected components of the graph below u that contain
+// a cycle, each sorted by name, using Tarjan's algorithm.
+func stronglyConnected(u *node) [][]*node {
+	index := make(map[*node]int)
+	lowlink := make(map[*node]int)
+	onstack := make(map[*node]bool)
+	stack := make([]*node, 0)
+	sccs := make([][]*node, 0)
+
+	var visit func(u *node)
+	visit = func(u *node) {
+		index[u] = len(index)
+		lowlink[u] = index[u]
+		stack = append(stack, u)
+		onstack[u] = true
+
+		selfloop := false
+		for _, e := range u.prereqs {
+			v := e.v
+			if v == nil {
+				continue
+			}
+			if v == u {
+				selfloop = true
+			}
+			if _, ok := index[v]; !ok {
+				visit(v)
+				if lowlink[v] < lowlink[u] {
+					lowlink[u] = lowlink[v]
 				}
+			} else if onstack[v] && index[v] < lowlink[u] {
+				lowlink[u] = index[v]
 			}
-			if !le.r.equivRecipe(e.r) {
-				if bad == 0 {
-					mkPrintError(fmt.Sprintf("mk: ambiguous recipes for %s\n", u.name))
-					bad = 1
-					g.trace(u.name, le)
+		}
+
+		if lowlink[u] == index[u] {
+			scc := make([]*node, 0)
+			for {
+				v := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onstack[v] = false
+				scc = append(scc, v)
+				if v == u {
+					break
 				}
-				g.trace(u.name, e)
+			}
+			if len(scc) > 1 || selfloop {
+				sort.Slice(scc, func(i, j int) bool { return scc[i].name < scc[j].name })
+				sccs = append(sccs, scc)
 			}
 		}
 	}
-	if bad > 0 {
-		mkError("")
+	visit(u)
+
+	sort.Slice(sccs, func(i, j int) bool { return sccs[i][0].name < sccs[j][0].name })
+	return sccs
+}
+
+// Describe the elementary cycles within a strongly connected component, each
+// starting from its first node in name order, adding to count and stopping
+// once it reaches maxCycles.
+func cyclesIn(scc []*node, count *int) string {
+	rank := make(map[*node]int, len(scc))
+	for i, u := range scc {
+		rank[u] = i
 	}
-	g.togo(u)
+
+	msg := ""
+	path := make([]*node, 0)
+	edges := make([]*edge, 0) // edges[i] leads from path[i] to path[i+1]
+	onpath := make(map[*node]bool)
+
+	var walk func(s *node, u *node)
+	walk = func(s *node, u *node) {
+		onpath[u] = true
+		path = append(path, u)
+		for _, e := range u.prereqs {
+			if *count == maxCycles {
+				break
+			}
+			r, ok := rank[e.v]
+			if e.v == nil || !ok || r < rank[s] {
+				continue
+			}
+			if e.v == s {
+				cycle := append(append([]*edge{}, edges...), e)
+				names := make([]string, len(path))
+				for j := range path {
+					names[j] = path[j].name
+				}
+				msg += fmt.Sprintf("mk: cycle in the graph: %s -> %s\n",
+					strings.Join(names, " -> "), s.name)
+				for j := range cycle {
+					msg += fmt.Sprintf("\t%s -> %s (%s:%d)\n", names[j],
+						cycle[j].v.name, cycle[j].r.file, cycle[j].r.line)
+				}
+				*count++
+			} else if !onpath[e.v] {
+				edges = append(edges, e)
+				walk(s, e.v)
+				edges = edges[:len(edges)-1]
+			}
+		}
+		path = path[:len(path)-1]
+		onpath[u] = false
+	}
+
+	for _, s := range scc {
+		walk(s, s)
+	}
+	return msg
+}
+
+// True if rule a takes precedence over rule b when both could build a target:
+// explicit rules over meta-rules, and meta-rules with a higher priority over
+// those with a lower one.
+func outranks(a *rule, b *rule) bool {
+	if a.ismeta != b.ismeta {
+		return !a.ismeta
+	}
+	return a.ismeta && a.attributes.priority > b.attributes.priority
 }
 
-// Print a trace of rules, k
-func (g *graph) trace(name string, e *edge) {
-	fmt.Fprintf(os.Stderr, "\t%s", name)
-	for true {
-		prereqname := ""
+// Describe a rule applied to a node, giving where it's from, its stem and the
+// prerequisites it gave.
+func (u *node) describeRule(r *rule) string {
+	stem := ""
+	prereqs := make([]string, 0)
+	for i := range u.prereqs {
+		e := u.prereqs[i]
+		if e.r != r {
+			continue
+		}
 		if e.v != nil {
-			prereqname = e.v.name
+			prereqs = append(prereqs, e.v.name)
+		}
+		if r.attributes.regex {
+			stems := make([]string, 0)
+			for j := 1; j < len(e.matches); j++ {
+				stems = append(stems, fmt.Sprintf("$stem%d = %s", j, e.matches[j]))
+			}
+			stem = " with " + strings.Join(stems, ", ")
+		} else if r.ismeta {
+			stem = fmt.Sprintf(" with $stem = %s", e.stem)
 		}
-		fmt.Fprintf(os.Stderr, " <-(%s:%d)- %s", e.r.file, e.r.line, prereqname)
+	}
+	return fmt.Sprintf("%s:%d: %s%s, prerequisites: %s", r.file, r.line,
+		r, stem, strings.Join(prereqs, " "))
+}
+
+// Deal with ambiguous rules, keeping only the rules of highest precedence and
+// failing if those have differing recipes.
+func (g *graph) ambiguous(u *node) {
+	if u.flags&nodeFlagUnambiguous != 0 {
+		return
+	}
+	u.flags |= nodeFlagUnambiguous
+
+	candidates := make([]*rule, 0)
+	for i := range u.prereqs {
+		e := u.prereqs[i]
 		if e.v != nil {
-			for i := range e.v.prereqs {
-				if e.v.prereqs[i].r.recipe != "" {
-					e = e.v.prereqs[i]
-					continue
-				}
+			g.ambiguous(e.v)
+		}
+		if e.r.recipe == "" {
+			continue
+		}
+		found := false
+		for _, r := range candidates {
+			found = found || r == e.r
+		}
+		if !found {
+			candidates = append(candidates, e.r)
+		}
+	}
+
+	var best *rule
+	for _, r := range candidates {
+		if best == nil || outranks(r, best) {
+			best = r
+		}
+	}
+
+	bad := false
+	for _, r := range candidates {
+		if !outranks(best, r) && !r.equivRecipe(best) {
+			bad = true
+		}
+	}
+
+	if bad {
+		conflicting := make([]*rule, 0)
+		for _, r := range candidates {
+			if !outranks(best, r) {
+				conflicting = append(conflicting, r)
 			}
-			break
-		} else {
-			break
 		}
+		if keepambiguous {
+			u.ambiguous = conflicting
+			return
+		}
+
+		msg := fmt.Sprintf("mk: ambiguous recipes for %s:\n", u.name)
+		for _, r := range conflicting {
+			msg += "\t" + u.describeRule(r) + "\n"
+		}
+		msg += fmt.Sprintf("add an explicit rule for %s, or give one rule a higher priority with the W attribute", u.name)
+		mkError(msg)
 	}
+
+	for i := range u.prereqs {
+		e := u.prereqs[i]
+		r := e.r
+		if r.scanned != nil {
+			r = r.scanned
+		}
+		if r.recipe != "" && outranks(best, r) {
+			e.togo = true
+			if best.ismeta {
+				e.reason = fmt.Sprintf("lower priority than the rule at %s:%d", best.file, best.line)
+			} else {
+				e.reason = fmt.Sprintf("overridden by the rule at %s:%d", best.file, best.line)
+			}
+		}
+	}
+	g.togo(u)
 }
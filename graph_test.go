@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Change to a new temporary directory holding the given files, for the rest of
+// the test. Files are given as name and contents.
+func inTempDir(tb testing.TB, files map[string]string) string {
+	tb.Helper()
+	dir := tb.TempDir()
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { os.Chdir(cwd) })
+
+	// state is kept per directory, so forget any read from another
+	for _, s := range stateFiles {
+		s.reset()
+	}
+	return dir
+}
+
+// Make the named files look as if last modified the given number of hours
+// ago.
+func setAge(tb testing.TB, ages map[string]int) {
+	tb.Helper()
+	for name, hours := range ages {
+		t := time.Now().Add(-time.Duration(hours) * time.Hour)
+		if err := os.Chtimes(name, t, t); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// Parse a mkfile in the current directory.
+func testRules(tb testing.TB, mkfile string) *ruleSet {
+	tb.Helper()
+	dir, err := os.Getwd()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return parse(mkfile, "mkfile", filepath.Join(dir, "mkfile"))
+}
+
+// Build the graph for the given targets of a mkfile in the current directory.
+func testGraph(tb testing.TB, mkfile string, targets ...string) *graph {
+	tb.Helper()
+	rs := testRules(tb, mkfile)
+	addRootRule(rs, targets)
+	return buildgraph(rs, "")
+}
+
+// Build a graph's targets running the given number of recipes at once,
+// returning the lines recipes appended to the file "log" in the order written,
+// and failing if the build hangs.
+func buildLog(tb testing.TB, g *graph, jobs int) []string {
+	tb.Helper()
+	quiet, allowed := quietall, subprocsAllowed
+	quietall, subprocsAllowed = true, jobs
+	defer func() { quietall, subprocsAllowed = quiet, allowed }()
+
+	done := make(chan bool)
+	go func() {
+		g.numberTurns([]*node{g.root})
+		mkNode(g, g.root, false, true)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		tb.Fatal("build didn't finish")
+	}
+
+	log, err := ioutil.ReadFile("log")
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(log))
+}
+
+// Build a graph's targets, returning the sorted lines recipes appended to the
+// file "log".
+func testBuild(tb testing.TB, g *graph) []string {
+	tb.Helper()
+	lines := buildLog(tb, g, 4)
+	sort.Strings(lines)
+	return lines
+}
+
+// Build a graph's targets as with -deterministic, or -shuffle if seed isn't
+// negative, returning the lines recipes appended to "log" in order. Recipes
+// run one at a time, so they finish in the order they start.
+func testOrderedBuild(tb testing.TB, g *graph, seed int64) []string {
+	tb.Helper()
+	det, rnd := deterministic, shuffleRand
+	deterministic, shuffleRand = true, nil
+	if seed >= 0 {
+		shuffleRand = rand.New(rand.NewSource(seed))
+		g.prioritize()
+	}
+	defer func() { deterministic, shuffleRand = det, rnd }()
+	return buildLog(tb, g, 1)
+}
+
+// Describe a node's prerequisites, in order, each followed by the kinds of its
+// edge. An edge with no prerequisite, left so a rule still applies, is "-".
+func edgeNames(u *node) string {
+	names := make([]string, 0, len(u.prereqs))
+	for _, e := range u.prereqs {
+		name := "-"
+		if e.v != nil {
+			name = e.v.name
+		}
+		if e.orderonly && !e.dyndep {
+			name += " (orderonly)"
+		}
+		if e.optional {
+			name += " (optional)"
+		}
+		if e.dyndep {
+			name += " (dyndep)"
+		}
+		if e.dynamic {
+			name += " (dynamic)"
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func TestOrderOnlyEdges(t *testing.T) {
+	tests := []struct {
+		mkfile string
+		target string
+		edges  string
+		prereq string
+	}{
+		{"x: a | d\n\techo $prereq\n", "x", "a, d (orderonly)", "a"},
+		{"x: | d e\n\techo $prereq\n", "x", "d (orderonly), e (orderonly)", ""},
+		{"%.o: %.c | %.dir gen\n\techo $prereq\n", "x.o",
+			"x.c, x.dir (orderonly), gen (orderonly)", "x.c"},
+	}
+	for _, test := range tests {
+		inTempDir(t, map[string]string{"a": "", "d": "", "e": "", "x.c": "", "x.dir": "", "gen": ""})
+		g := testGraph(t, test.mkfile, test.target)
+		u := g.nodes[test.target]
+		if got := edgeNames(u); got != test.edges {
+			t.Errorf("%q: edges %q, want %q", test.mkfile, got, test.edges)
+		}
+		recipe := strings.TrimSpace(expandRecipe(u.name, u, u.ruleEdge()))
+		if got := strings.TrimSpace(strings.TrimPrefix(recipe, "echo")); got != test.prereq {
+			t.Errorf("%q: $prereq %q, want %q", test.mkfile, got, test.prereq)
+		}
+	}
+}
+
+// Only the existence of an order-only prerequisite matters, not its time.
+func TestOrderOnlyBuild(t *testing.T) {
+	mkfile := "x: a | d\n\techo x >> log; touch x\nd:\n\techo d >> log; mkdir d\n"
+	tests := []struct {
+		files map[string]string
+		ages  map[string]int
+		built string
+	}{
+		{map[string]string{"x": "", "a": "", "d/f": ""}, map[string]int{"a": 3, "x": 2, "d": 1}, ""},
+		{map[string]string{"x": "", "a": "", "d/f": ""}, map[string]int{"d": 3, "x": 2, "a": 1}, "x"},
+		// they're only built when the target needs to be
+		{map[string]string{"x": "", "a": ""}, map[string]int{"a": 2, "x": 1}, ""},
+		{map[string]string{"a": ""}, nil, "d x"},
+	}
+	for _, test := range tests {
+		inTempDir(t, test.files)
+		setAge(t, test.ages)
+		g := testGraph(t, mkfile, "x")
+		if got := strings.Join(testBuild(t, g), " "); got != test.built {
+			t.Errorf("with %v aged %v: built %q, want %q", test.files, test.ages, got, test.built)
+		}
+	}
+}
+
+func TestRemoveIntermediates(t *testing.T) {
+	chain := "%.o: %.c\n\tcat $prereq > $target\n%.c: %.y\n\tcat $prereq > $target\n"
+	tests := []struct {
+		mkfile  string
+		files   string
+		targets string
+		left    string
+	}{
+		{"prog: p.o\n\tcat $prereq > $target\n" + chain, "p.y", "prog", "p.o p.y prog"},
+		// it may have been edited by hand
+		{"prog: p.o\n\tcat $prereq > $target\n" + chain, "p.y p.c", "prog", "p.c p.o p.y prog"},
+		{chain, "p.y", "p.o", "p.o p.y"},
+		{chain, "p.y", "p.o p.c", "p.c p.o p.y"},
+		{"prog: p.o\n\tcat $prereq > $target\n%.o: %.c\n\tcat $prereq > $target\n%.c:K: %.y\n\tcat $prereq > $target\n",
+			"p.y", "prog", "p.c p.o p.y prog"},
+		{"prog: p.o\n\tcat $prereq > $target\np.c: p.y\n\tcat $prereq > $target\n" + chain,
+			"p.y", "prog", "p.c p.o p.y prog"},
+		{"%.out:Y%.dd: %.y\n\tcat $prereq > $target\n%.dd: %.in\n\tcp $prereq $target\n",
+			"p.y p.in", "p.out", "p.dd p.in p.out p.y"},
+	}
+	for _, test := range tests {
+		files := make(map[string]string)
+		for _, name := range strings.Fields(test.files) {
+			files[name] = ""
+		}
+		inTempDir(t, files)
+
+		g := testGraph(t, test.mkfile, strings.Fields(test.targets)...)
+		testBuild(t, g)
+		g.removeIntermediates()
+
+		infos, err := ioutil.ReadDir(".")
+		if err != nil {
+			t.Fatal(err)
+		}
+		left := make([]string, 0)
+		for _, info := range infos {
+			if !info.IsDir() {
+				left = append(left, info.Name())
+			}
+		}
+		if got := strings.Join(left, " "); got != test.left {
+			t.Errorf("%q with files %q, making %q: left %q, want %q",
+				test.mkfile, test.files, test.targets, got, test.left)
+		}
+	}
+}
+
+// Run f, returning the message of any error it raises with mkError.
+func catchError(f func()) (msg string) {
+	defer func(s bool) {
+		serving = s
+		if r := recover(); r != nil {
+			failure, ok := r.(mkFailure)
+			if !ok {
+				panic(r)
+			}
+			msg = string(failure)
+		}
+	}(serving)
+	serving = true
+	f()
+	return ""
+}
+
+func TestCycles(t *testing.T) {
+	tests := []struct {
+		mkfile string
+		cycles string
+	}{
+		{"a: b\nb: c\n", ""},
+		{"a: a\n", "a -> a"},
+		{"a: b c\nb: c\nc: a\n", "a -> b -> c -> a; a -> c -> a"},
+		{"x: a d\na: b\nb: a\nd: e\ne: d\n", "a -> b -> a; d -> e -> d"},
+		{"a: b\nb: c a\nc: b\n", "a -> b -> a; b -> c -> b"},
+	}
+	for _, test := range tests {
+		inTempDir(t, nil)
+		rs := testRules(t, test.mkfile)
+		msg := catchError(func() { buildgraph(rs, rs.rules[0].targets[0].spat) })
+
+		cycles := make([]string, 0)
+		for _, line := range strings.Split(msg, "\n") {
+			if strings.HasPrefix(line, "mk: cycle in the graph: ") {
+				cycles = append(cycles, strings.TrimPrefix(line, "mk: cycle in the graph: "))
+			}
+		}
+		if got := strings.Join(cycles, "; "); got != test.cycles {
+			t.Errorf("%q: cycles %q, want %q", test.mkfile, got, test.cycles)
+		}
+		if strings.HasSuffix(msg, "\n") {
+			t.Errorf("%q: message ends with a newline", test.mkfile)
+		}
+	}
+}
+
+func TestChainsRecur(t *testing.T) {
+	tests := []struct {
+		mkfile string
+		recur  bool
+	}{
+		{"%.o: %.c\n\tcc $prereq\n%.c: %.y\n\tyacc $prereq\n", false},
+		{"%: %.in\n\tcp $prereq $target\n", true},
+		{"(.*)\\.gz:R: $stem1\n\tgzip $stem1\n", true},
+		{"%.o: %.c\n\tcc $prereq\nfoo.c: bar.o\n\tgen $prereq\n", true},
+		{"prog: a.o b.o\n\tld $prereq\n%.o: %.c\n\tcc $prereq\n", false},
+	}
+	for _, test := range tests {
+		inTempDir(t, nil)
+		rs := testRules(t, test.mkfile)
+		if recur := rs.chainsRecur(rs.indexMeta()); recur != test.recur {
+			t.Errorf("chainsRecur(%q) = %v, want %v", test.mkfile, recur, test.recur)
+		}
+	}
+}
+
+// A mkfile building n objects, from sources that exist, with many meta-rules
+// that don't apply to them and several that could produce a source.
+func benchMkfile(n int) (string, map[string]string) {
+	files := make(map[string]string, n)
+	var b strings.Builder
+	b.WriteString("OBJS=")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, " obj/f%d.o", i)
+		files[fmt.Sprintf("src/f%d.c", i)] = ""
+	}
+	b.WriteString("\nall:V: prog\nprog: $OBJS\n\tld -o $target $prereq\n")
+	b.WriteString("%.c: %.y\n\tyacc $prereq\n%.c: %.l\n\tlex $prereq\n%.c: %.cc\n\tgen $prereq\n")
+	b.WriteString("obj/%.o: src/%.c\n\tcc -c $prereq -o $target\n")
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&b, "%%.out%d: %%.in%d\n\tconvert $prereq $target\n", i, i)
+	}
+	return b.String(), files
+}
+
+// Build the same graph with the meta-rule index and concurrent matching each
+// switched on and off.
+func BenchmarkBuildgraph(b *testing.B) {
+	for _, n := range []int{1000, 20000, 100000} {
+		for _, indexed := range []bool{true, false} {
+			for _, concurrent := range []bool{true, false} {
+				name := fmt.Sprintf("objects=%d/indexed=%v/concurrent=%v", n, indexed, concurrent)
+				b.Run(name, func(b *testing.B) {
+					mkfile, files := benchMkfile(n)
+					inTempDir(b, files)
+					rs := testRules(b, mkfile)
+					addRootRule(rs, []string{"all"})
+
+					mi, cp := metaIndexed, concurrentPrereqs
+					metaIndexed, concurrentPrereqs = indexed, concurrent
+					defer func() { metaIndexed, concurrentPrereqs = mi, cp }()
+
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						g := buildgraph(rs, "")
+						if len(g.nodes) < 2*n {
+							b.Fatalf("graph has %d nodes, expected at least %d", len(g.nodes), 2*n)
+						}
+					}
+				})
+			}
+		}
+	}
+}
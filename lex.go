@@ -56,6 +56,7 @@ type token struct {
 	val  string    // token string
 	line int       // line where it was found
 	col  int       // column on which the token began
+	doc  string    // comment block immediately preceding a word
 }
 
 func (t *token) String() string {
@@ -79,6 +80,7 @@ type lexer struct {
 	errmsg    string     // set to an appropriate error message when necessary
 	indented  bool       // true if the only whitespace so far on this line
 	barewords bool       // lex only a sequence of words
+	comment   string     // comment lines read since the last blank line or token
 }
 
 // A lexerStateFun is simultaneously the the state of the lexer and the next
@@ -144,7 +146,17 @@ func (l *lexer) skip() {
 }
 
 func (l *lexer) emit(typ tokenType) {
-	l.output <- token{typ, l.input[l.start:l.pos], l.line, l.startcol}
+	t := token{typ, l.input[l.start:l.pos], l.line, l.startcol, ""}
+
+	// comments document the word that follows them
+	if typ == tokenWord {
+		t.doc = l.comment
+	}
+	if typ != tokenNewline {
+		l.comment = ""
+	}
+
+	l.output <- t
 	l.start = l.pos
 	l.startcol = 0
 }
@@ -248,7 +260,13 @@ func lexTopLevel(l *lexer) lexerStateFun {
 				l.emit(tokenNewline)
 			}
 		}
+
+		// a blank line separates comments from what follows
+		line := l.line
 		l.skipRun(" \t\r\n")
+		if l.line > line {
+			l.comment = ""
+		}
 
 		if l.peek() == '\\' && l.peekN(1) == '\n' {
 			l.next()
@@ -299,8 +317,16 @@ func lexAssign(l *lexer) lexerStateFun {
 }
 
 func lexComment(l *lexer) lexerStateFun {
+	ownline := l.col == 0
 	l.skip() // '#'
+	start := l.pos
 	l.skipUntil("\n")
+
+	// keep comments on lines of their own, which may document a rule
+	if ownline {
+		text := strings.TrimRight(l.input[start:l.pos], " \t\r")
+		l.comment += strings.TrimPrefix(text, " ") + "\n"
+	}
 	return lexTopLevel
 }
 
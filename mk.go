@@ -2,13 +2,16 @@ package main
 
 import (
 	"bufio"
+	"container/heap"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 // True if messages should be printed without fancy colors.
@@ -17,14 +20,27 @@ var nocolor bool = false
 // True if we are ignoring timestamps and rebuilding everything.
 var rebuildall bool = false
 
+// True if parent directories of targets are created for every rule, as if it
+// had the M attribute.
+var mkdirs bool = false
+
+// True if no recipes are printed, as if every rule had the Q attribute. Set for
+// builds served with -q.
+var quietall bool = false
+
+// True if ambiguous recipes are recorded on their node rather than being an
+// error, so that -which can list them.
+var keepambiguous bool = false
+
 // Set of targets for which we are forcing rebuild
 var rebuildtargets map[string]bool = make(map[string]bool)
 
 // Lock on standard out, messages don't get interleaved too much.
 var mkMsgMutex sync.Mutex
 
-// The maximum number of times an rule may be applied.
-const maxRuleCnt = 1
+// The maximum number of times an rule may be applied, unless the rule says
+// otherwise.
+var maxRuleCnt int = 1
 
 // Limit the number of recipes executed simultaneously.
 var subprocsAllowed int
@@ -35,24 +51,46 @@ var subprocsRunning int
 // Wakeup on a free subprocess slot.
 var subprocsRunningCond *sync.Cond = sync.NewCond(&sync.Mutex{})
 
+// Recipes waiting for a subprocess slot.
+var subprocsWaiting subprocQueue
+
+// Number of recipes that have waited for a slot.
+var subprocsWaited int
+
+// True while an exclusive recipe is taking every slot.
+var subprocsStealing bool
+
 // Prevent more than one recipe at a time from trying to take over
 var exclusiveSubproc = sync.Mutex{}
 
-// Wait until there is an available subprocess slot.
-func reserveSubproc() {
+// Wait until there is an available subprocess slot. When slots are scarce,
+// they go to the waiting recipe with the highest priority.
+func reserveSubproc(priority time.Duration) {
 	subprocsRunningCond.L.Lock()
-	for subprocsRunning >= subprocsAllowed {
-		subprocsRunningCond.Wait()
+	if subprocsRunning < subprocsAllowed && len(subprocsWaiting) == 0 {
+		subprocsRunning++
+		subprocsRunningCond.L.Unlock()
+		return
 	}
-	subprocsRunning++
+
+	w := &subprocWaiter{priority, subprocsWaited, make(chan bool, 1)}
+	subprocsWaited++
+	heap.Push(&subprocsWaiting, w)
 	subprocsRunningCond.L.Unlock()
+
+	// the slot is counted as running by whoever hands it over
+	<-w.ready
 }
 
 // Free up another subprocess to run.
 func finishSubproc() {
 	subprocsRunningCond.L.Lock()
-	subprocsRunning--
-	subprocsRunningCond.Signal()
+	if len(subprocsWaiting) > 0 && !subprocsStealing {
+		wakeSubproc()
+	} else {
+		subprocsRunning--
+		subprocsRunningCond.Signal()
+	}
 	subprocsRunningCond.L.Unlock()
 }
 
@@ -62,6 +100,7 @@ func reserveExclusiveSubproc() {
 	// Wait until everything is done running
 	stolen_subprocs := 0
 	subprocsRunningCond.L.Lock()
+	subprocsStealing = true
 	stolen_subprocs = subprocsAllowed - subprocsRunning
 	subprocsRunning = subprocsAllowed
 	for stolen_subprocs < subprocsAllowed {
@@ -72,8 +111,12 @@ func reserveExclusiveSubproc() {
 }
 
 func finishExclusiveSubproc() {
+	subprocsStealing = false
 	subprocsRunning = 0
-	subprocsRunningCond.Broadcast()
+	for subprocsRunning < subprocsAllowed && len(subprocsWaiting) > 0 {
+		subprocsRunning++
+		wakeSubproc()
+	}
 	subprocsRunningCond.L.Unlock()
 	exclusiveSubproc.Unlock()
 }
@@ -98,6 +141,10 @@ func mkNodePrereqs(g *graph, u *node, e *edge, prereqs []*node, dryrun bool,
 	prereqstat := make(chan nodeStatus)
 	pending := 0
 
+	// start those on the critical path first
+	prereqs = append([]*node(nil), prereqs...)
+	sortByPriority(prereqs)
+
 	// build prereqs that need building
 	for i := range prereqs {
 		prereqs[i].mutex.Lock()
@@ -158,6 +205,22 @@ func mkNode(g *graph, u *node, dryrun bool, required bool) {
 		u.mutex.Unlock()
 	}()
 
+	// when serving, an error fails the node rather than the whole server
+	defer func() {
+		if serving {
+			if r := recover(); r != nil {
+				if _, ok := r.(mkFailure); !ok {
+					panic(r)
+				}
+				finalstatus = nodeStatusFailed
+			}
+		}
+	}()
+
+	// in a deterministic build, the next node waits until this one is done
+	// with, or its recipe has been printed
+	defer passTurn(u)
+
 	// there's no fucking rules, dude
 	if len(u.prereqs) == 0 {
 		if !(u.r != nil && u.r.attributes.virtual) && !u.exists {
@@ -170,13 +233,21 @@ func mkNode(g *graph, u *node, dryrun bool, required bool) {
 
 	// there should otherwise be exactly one edge with an associated rule
 	prereqs := make([]*node, 0)
-	var e *edge = nil
+	orderonly := make(map[*node]bool)
+	e := u.ruleEdge()
 	for i := range u.prereqs {
-		if u.prereqs[i].r != nil {
-			e = u.prereqs[i]
-		}
 		if u.prereqs[i].v != nil {
 			prereqs = append(prereqs, u.prereqs[i].v)
+			if u.prereqs[i].orderonly {
+				orderonly[u.prereqs[i].v] = true
+			}
+		}
+	}
+
+	// a node that's also an ordinary prerequisite is compared as usual
+	for i := range u.prereqs {
+		if u.prereqs[i].v != nil && !u.prereqs[i].orderonly {
+			delete(orderonly, u.prereqs[i].v)
 		}
 	}
 
@@ -189,14 +260,28 @@ func mkNode(g *graph, u *node, dryrun bool, required bool) {
 	prereqs_required := required && (e.r.attributes.virtual || !u.exists)
 	mkNodePrereqs(g, u, e, prereqs, dryrun, prereqs_required)
 
+	// the dyndep file may add more
+	if e.r.attributes.dyndep != "" {
+		more := g.dyndep(u, e, dryrun)
+		mkNodePrereqs(g, u, e, more, dryrun, prereqs_required)
+		prereqs = append(prereqs, more...)
+	}
+
 	uptodate := true
 	if !e.r.attributes.virtual {
 		u.updateTimestamp()
 		if !u.exists && required {
 			uptodate = false
 		} else if u.exists || required {
+			t := u.t
+			if e.r.attributes.restat {
+				t = restatTime(u)
+			}
 			for i := range prereqs {
-				if u.t.Before(prereqs[i].t) || prereqs[i].status == nodeStatusDone {
+				if orderonly[prereqs[i]] {
+					continue
+				}
+				if t.Before(prereqs[i].t) || prereqs[i].status == nodeStatusDone {
 					uptodate = false
 				}
 			}
@@ -207,6 +292,25 @@ func mkNode(g *graph, u *node, dryrun bool, required bool) {
 		uptodate = false
 	}
 
+	// a missing intermediate is as new as what it's made from, so it's only
+	// remade if something depending on it needs to be
+	if uptodate && !u.exists && u.flags&nodeFlagIntermediate != 0 {
+		for i := range prereqs {
+			if !orderonly[prereqs[i]] && u.t.Before(prereqs[i].t) {
+				u.t = prereqs[i].t
+			}
+		}
+	}
+
+	// as is a change in which optional prerequisites exist
+	var optional []string
+	if e.r.hasOptional() {
+		optional = presentOptional(u, e)
+		if optionalDiffer(u.name, optional) {
+			uptodate = false
+		}
+	}
+
 	_, isrebuildtarget := rebuildtargets[u.name]
 	if isrebuildtarget || rebuildall {
 		uptodate = false
@@ -217,18 +321,49 @@ func mkNode(g *graph, u *node, dryrun bool, required bool) {
 		mkNodePrereqs(g, u, e, prereqs, dryrun, true)
 	}
 
+	waitTurn(u)
+
 	// execute the recipe, unless the prereqs failed
 	if !uptodate && finalstatus != nodeStatusFailed && len(e.r.recipe) > 0 {
 		if e.r.attributes.exclusive {
 			reserveExclusiveSubproc()
 		} else {
-			reserveSubproc()
+			reserveSubproc(u.priority)
+		}
+
+		existed := u.exists
+		restat := e.r.attributes.restat && !dryrun
+		var before targetState
+		if restat {
+			before = statTarget(u.name)
 		}
 
-		if !dorecipe(u.name, u, e, dryrun) {
+		if (mkdirs || e.r.attributes.mkdirs) && !dryrun && !mkTargetDirs(u, e) {
+			finalstatus = nodeStatusFailed
+		} else if !dorecipe(u.name, u, e, dryrun) {
 			finalstatus = nodeStatusFailed
 		}
 		u.updateTimestamp()
+		if !existed && u.exists && !dryrun && finalstatus != nodeStatusFailed {
+			u.flags |= nodeFlagCreated
+		}
+
+		// if the recipe left the target alone, what depends on it needn't
+		// be rebuilt
+		if restat && finalstatus != nodeStatusFailed {
+			if restatUnchanged(u, before) {
+				finalstatus = nodeStatusNop
+				var newest time.Time
+				for i := range prereqs {
+					if !orderonly[prereqs[i]] && newest.Before(prereqs[i].t) {
+						newest = prereqs[i].t
+					}
+				}
+				noteRestat(u.name, newest)
+			} else {
+				noteRestat(u.name, time.Time{})
+			}
+		}
 
 		if e.r.attributes.exclusive {
 			finishExclusiveSubproc()
@@ -238,10 +373,19 @@ func mkNode(g *graph, u *node, dryrun bool, required bool) {
 	} else if finalstatus != nodeStatusFailed {
 		finalstatus = nodeStatusNop
 	}
+
+	if e.r.hasOptional() && !dryrun && finalstatus != nodeStatusFailed {
+		noteOptional(u.name, optional)
+	}
 }
 
 func mkError(msg string) {
 	mkPrintError(msg)
+	if serving {
+		panic(mkFailure(msg))
+	}
+	// keep what was learned from any recipes that already ran
+	saveState()
 	os.Exit(1)
 }
 
@@ -300,12 +444,83 @@ func mkPrintRecipe(target string, recipe string, quiet bool) {
 	mkMsgMutex.Unlock()
 }
 
+// Read and parse the mkfile at the given path, remaking any included files
+// that are out of date if remake is set.
+func parseMkfile(mkfilepath string, remake bool) *ruleSet {
+	rs := readMkfile(mkfilepath)
+	if remake {
+		return remakeMkfiles(mkfilepath, rs)
+	}
+	for _, inc := range rs.includes {
+		if inc.missing {
+			mkError(fmt.Sprintf("%s:%d: syntax error: cannot open %s", inc.file, inc.line, inc.name))
+		}
+	}
+	return rs
+}
+
+// Read and parse the mkfile at the given path.
+func readMkfile(mkfilepath string) *ruleSet {
+	mkfile, err := os.Open(mkfilepath)
+	if err != nil {
+		mkError("no mkfile found")
+	}
+	input, _ := ioutil.ReadAll(mkfile)
+	mkfile.Close()
+
+	abspath, err := filepath.Abs(mkfilepath)
+	if err != nil {
+		mkError("unable to find mkfile's absolute path")
+	}
+
+	return parse(string(input), mkfilepath, abspath)
+}
+
+// Targets to build, given those requested on the command line.
+func defaultTargets(rs *ruleSet, targets []string) []string {
+	// build the first non-meta rule in the makefile, if none are given explicitly
+	if len(targets) == 0 {
+		for i := range rs.rules {
+			if !rs.rules[i].ismeta {
+				for j := range rs.rules[i].targets {
+					targets = append(targets, rs.rules[i].targets[j].spat)
+				}
+				break
+			}
+		}
+	}
+	return targets
+}
+
+// Create a dummy virtual rule that depends on every target. This becomes the
+// root of the graph built for the target "".
+func addRootRule(rs *ruleSet, targets []string) {
+	root := rule{}
+	root.targets = []pattern{pattern{false, "", nil}}
+	root.attributes = attribSet{virtual: true}
+	root.prereqs = targets
+	rs.add(root)
+}
+
 func main() {
 	var mkfilepath string
 	var interactive bool
 	var dryrun bool
 	var shallowrebuild bool
 	var quiet bool
+	var server bool
+	var client bool
+	var watch bool
+	var rerunfailed bool
+	var visualize bool
+	var exportjson bool
+	var whytarget string
+	var depstarget string
+	var rdepstarget string
+	var whichtarget string
+	var listtargets bool
+	var shuffle shuffleFlag
+	var rmintermediate bool
 
 	flag.StringVar(&mkfilepath, "f", "mkfile", "use the given file as mkfile")
 	flag.BoolVar(&dryrun, "n", false, "print commands without actually executing")
@@ -314,37 +529,99 @@ func main() {
 	flag.IntVar(&subprocsAllowed, "p", 4, "maximum number of jobs to execute in parallel")
 	flag.BoolVar(&interactive, "i", false, "prompt before executing rules")
 	flag.BoolVar(&quiet, "q", false, "don't print recipes before executing them")
+	flag.BoolVar(&traceaccess, "trace", false, "trace the files recipes open and report missing prerequisites")
+	flag.BoolVar(&tracerecord, "trace-record", false, "like -trace, but also record missing prerequisites for later runs")
+	flag.BoolVar(&server, "server", false, "keep the graph in memory and serve builds over a socket")
+	flag.BoolVar(&client, "c", false, "have a running mk -server perform the build")
+	flag.BoolVar(&rerunfailed, "rerun-failed", false, "build only the targets that failed in earlier builds")
+	flag.BoolVar(&skipfailed, "skip-failed", false, "don't rerun recipes that failed before with identical inputs")
+	flag.BoolVar(&visualize, "graph", false, "print the graph in graphviz format rather than building")
+	flag.BoolVar(&exportjson, "json", false, "print the graph as JSON rather than building")
+	flag.StringVar(&whytarget, "why", "", "print every path by which the targets depend on the given file")
+	flag.StringVar(&depstarget, "deps", "", "print everything the given target depends on")
+	flag.StringVar(&rdepstarget, "rdeps", "", "print every target that depends on the given file")
+	flag.StringVar(&whichtarget, "which", "", "print the rule that would build the given target, and why")
+	flag.BoolVar(&listtargets, "l", false, "list targets and their descriptions")
+	flag.IntVar(&maxRuleCnt, "rulelimit", 1, "maximum number of times a meta-rule may be applied in a chain")
+	flag.BoolVar(&mkdirs, "mkdirs", false, "create the parent directories of targets before running recipes")
+	flag.BoolVar(&watch, "w", false, "after building, rebuild targets whenever their sources change")
+	flag.BoolVar(&rmintermediate, "rm-intermediate", false, "remove intermediate files made by chains of meta-rules after building")
+	flag.BoolVar(&deterministic, "deterministic", false, "start recipes in a fixed order, so output is reproducible")
+	flag.Var(&shuffle, "shuffle", "start recipes in a random order, optionally given a seed as -shuffle=seed; implies -deterministic")
 	flag.Parse()
 
-	mkfile, err := os.Open(mkfilepath)
-	if err != nil {
-		mkError("no mkfile found")
+	if client {
+		// the server builds with its own settings, other than these
+		forwarded := map[string]bool{"c": true, "n": true, "a": true, "r": true, "q": true, "p": true}
+		jobs := 0
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "p" {
+				jobs = subprocsAllowed
+			} else if !forwarded[f.Name] {
+				mkError(fmt.Sprintf("mk: -%s can't be used with -c", f.Name))
+			}
+		})
+		os.Exit(runClient(serverRequest{flag.Args(), dryrun, rebuildall, shallowrebuild, quiet, jobs}))
 	}
-	input, _ := ioutil.ReadAll(mkfile)
-	mkfile.Close()
 
-	abspath, err := filepath.Abs(mkfilepath)
-	if err != nil {
-		mkError("unable to find mkfile's absolute path")
+	if shuffle.set {
+		// the order is only reproducible if recipes start one at a time
+		deterministic = true
+		shuffleRand = rand.New(rand.NewSource(shuffle.seed))
+		mkPrintMessage(fmt.Sprintf("mk: shuffling with -shuffle=%d", shuffle.seed))
+	}
+
+	if tracerecord {
+		traceaccess = true
+	}
+	if traceaccess && !traceSupported {
+		mkError("mk: -trace is not supported on this platform")
 	}
 
-	rs := parse(string(input), mkfilepath, abspath)
+	if server {
+		serve(mkfilepath)
+		return
+	}
+
+	// nothing is run for a dry run or a query, included files included
+	query := listtargets || visualize || exportjson || whytarget != "" ||
+		depstarget != "" || rdepstarget != "" || whichtarget != ""
+	rs := parseMkfile(mkfilepath, !dryrun && !query)
 	if quiet {
 		for i := range rs.rules {
 			rs.rules[i].attributes.quiet = true
 		}
 	}
 
-	targets := flag.Args()
+	if listtargets {
+		rs.list(os.Stdout)
+		return
+	}
 
-	// build the first non-meta rule in the makefile, if none are given explicitly
-	if len(targets) == 0 {
-		for i := range rs.rules {
-			if !rs.rules[i].ismeta {
-				for j := range rs.rules[i].targets {
-					targets = append(targets, rs.rules[i].targets[j].spat)
-				}
-				break
+	targets := defaultTargets(rs, flag.Args())
+	for _, query := range []string{depstarget, whichtarget} {
+		if query != "" {
+			if len(flag.Args()) == 0 {
+				targets = []string{query}
+			} else {
+				targets = append(targets, query)
+			}
+		}
+	}
+	if rerunfailed {
+		// failed targets are built along with any given ones, rather than
+		// the default
+		if len(flag.Args()) == 0 {
+			targets = nil
+		}
+		given := make(map[string]bool, len(targets))
+		for i := range targets {
+			given[targets[i]] = true
+		}
+		for _, target := range failedTargetNames() {
+			rebuildtargets[target] = true
+			if !given[target] {
+				targets = append(targets, target)
 			}
 		}
 	}
@@ -354,21 +631,51 @@ func main() {
 		return
 	}
 
+	addRecordedDeps(rs)
+
 	if shallowrebuild {
 		for i := range targets {
 			rebuildtargets[targets[i]] = true
 		}
 	}
 
-	// Create a dummy virtual rule that depends on every target
-	root := rule{}
-	root.targets = []pattern{pattern{false, "", nil}}
-	root.attributes = attribSet{false, false, false, false, false, false, false, true, false}
-	root.prereqs = targets
-	rs.add(root)
+	addRootRule(rs, targets)
+
+	if visualize {
+		g := buildgraph(rs, "")
+		g.visualize(os.Stdout)
+		return
+	}
+
+	if whytarget != "" || depstarget != "" || rdepstarget != "" || whichtarget != "" {
+		keepambiguous = whichtarget != ""
+		g := buildgraph(rs, "")
+		if whytarget != "" {
+			g.why(os.Stdout, whytarget)
+		}
+		if depstarget != "" {
+			g.deps(os.Stdout, depstarget)
+		}
+		if rdepstarget != "" {
+			g.rdeps(os.Stdout, rdepstarget)
+		}
+		if whichtarget != "" {
+			g.which(os.Stdout, whichtarget)
+		}
+		return
+	}
+
+	if exportjson {
+		g := buildgraph(rs, "")
+		if err := g.exportJSON(os.Stdout); err != nil {
+			mkError(err.Error())
+		}
+		return
+	}
 
 	if interactive {
 		g := buildgraph(rs, "")
+		g.numberTurns([]*node{g.root})
 		mkNode(g, g.root, true, true)
 		fmt.Print("Proceed? ")
 		in := bufio.NewReader(os.Stdin)
@@ -387,5 +694,14 @@ func main() {
 	}
 
 	g := buildgraph(rs, "")
+	g.numberTurns([]*node{g.root})
 	mkNode(g, g.root, dryrun, true)
+	saveState()
+	if rmintermediate && !dryrun {
+		g.removeIntermediates()
+	}
+
+	if watch {
+		watchBuild(mkfilepath, quiet, targets, rs, g, dryrun)
+	}
 }
@@ -0,0 +1,63 @@
+// Optional prerequisites, marked with a leading '?', which are used if they
+// exist and dropped otherwise. Which ones existed when a target was last built
+// is remembered, so one appearing or disappearing makes the target out of
+// date.
+
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Targets mapped to the tab separated optional prerequisites they were last
+// built with.
+var optionalPrereqs = newStateFile("optional", "optional prerequisites")
+
+// Strip the '?' marking optional prerequisites, returning which were marked.
+func stripOptional(prereqs []string) []bool {
+	optional := make([]bool, len(prereqs))
+	for i := range prereqs {
+		if strings.HasPrefix(prereqs[i], "?") {
+			prereqs[i] = prereqs[i][1:]
+			optional[i] = true
+		}
+	}
+	return optional
+}
+
+// True if the rule has any optional prerequisites, ordinary or order-only.
+func (r *rule) hasOptional() bool {
+	for _, prereq := range append(append([]string{}, r.prereqs...), r.orderonly...) {
+		if strings.HasPrefix(prereq, "?") {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the optional prerequisites of a node's rule that weren't dropped, in
+// sorted order.
+func presentOptional(u *node, e *edge) []string {
+	names := make([]string, 0)
+	for i := range u.prereqs {
+		f := u.prereqs[i]
+		if f.r == e.r && f.optional && f.v != nil {
+			names = append(names, f.v.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// True if the optional prerequisites a target was last built with are known,
+// and differ from the given ones.
+func optionalDiffer(target string, names []string) bool {
+	prev, ok := optionalPrereqs.get(target)
+	return ok && prev != strings.Join(names, "\t")
+}
+
+// Remember the optional prerequisites a target is up to date with.
+func noteOptional(target string, names []string) {
+	optionalPrereqs.set(target, strings.Join(names, "\t"))
+}
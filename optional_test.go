@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestOptionalPruning(t *testing.T) {
+	tests := []struct {
+		mkfile string
+		files  string
+		all    bool
+		target string
+		edges  string
+	}{
+		{"config.h: config.def.h ?config.local\n\tcat $prereq > $target\n",
+			"config.def.h", false, "config.h", "config.def.h"},
+		{"config.h: config.def.h ?config.local\n\tcat $prereq > $target\n",
+			"config.def.h config.local", false, "config.h", "config.def.h, config.local (optional)"},
+		// -a doesn't make a missing optional prerequisite possible to make
+		{"config.h: config.def.h ?config.local\n\tcat $prereq > $target\n",
+			"config.def.h", true, "config.h", "config.def.h"},
+		{"x: ?y\n\ttouch x\ny:\n\ttouch y\n", "", false, "x", "y (optional)"},
+		{"x: ?y\n\ttouch x\n%: %.in\n\tcp $prereq $target\n", "y.in", false, "x", "y (optional)"},
+		{"x: a | ?d\n\ttouch x\n", "a", false, "x", "a"},
+		{"x: a | ?d\n\ttouch x\n", "a d", true, "x", "a, d (orderonly) (optional)"},
+		// an explicit rule left with nothing still applies, a meta-rule doesn't
+		{"x.o: ?x.local\n\ttouch x.o\n", "", false, "x.o", "-"},
+		{"%.o: ?%.local\n\ttouch $target\n", "", false, "x.o", ""},
+		{"%.o: ?%.local\n\ttouch $target\n%.o: %.c\n\tcc $prereq\n", "x.c", false, "x.o", "x.c"},
+	}
+	for _, test := range tests {
+		files := make(map[string]string)
+		for _, name := range strings.Fields(test.files) {
+			files[name] = ""
+		}
+		inTempDir(t, files)
+
+		all := rebuildall
+		rebuildall = test.all
+		g := testGraph(t, test.mkfile, test.target)
+		rebuildall = all
+
+		if got := edgeNames(g.nodes[test.target]); got != test.edges {
+			t.Errorf("%q with files %q, -a %v: edges %q, want %q",
+				test.mkfile, test.files, test.all, got, test.edges)
+		}
+	}
+}
+
+// A target is rebuilt when an optional prerequisite appears or disappears.
+func TestOptionalRebuild(t *testing.T) {
+	mkfile := "x: a ?b\n\techo x >> log; touch x\n"
+	inTempDir(t, map[string]string{"a": ""})
+	setAge(t, map[string]int{"a": 1})
+
+	steps := []struct {
+		create, remove string
+		built          string
+	}{
+		{"", "", "x"},
+		{"", "", "x"},
+		{"b", "", "x x"},
+		{"", "", "x x"},
+		{"", "b", "x x x"},
+	}
+	for i, step := range steps {
+		if step.create != "" {
+			if err := ioutil.WriteFile(step.create, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			// older than x, so only its appearing can rebuild x
+			setAge(t, map[string]int{step.create: 1})
+		}
+		if step.remove != "" {
+			if err := os.Remove(step.remove); err != nil {
+				t.Fatal(err)
+			}
+		}
+		g := testGraph(t, mkfile, "x")
+		if got := strings.Join(testBuild(t, g), " "); got != step.built {
+			t.Errorf("step %d: built %q, want %q", i, got, step.built)
+		}
+	}
+}
@@ -55,7 +55,9 @@ type parserStateFun func(*parser, token) parserStateFun
 func parse(input string, name string, path string) *ruleSet {
 	rules := &ruleSet{make(map[string][]string),
 		make([]rule, 0),
-		make(map[string][]int)}
+		make(map[string][]int),
+		[]string{path},
+		nil}
 	parseInto(input, name, rules, path)
 	return rules
 }
@@ -78,7 +80,7 @@ func parseInto(input string, name string, rules *ruleSet, path string) {
 
 	// insert a dummy newline to allow parsing of any assignments or recipeless
 	// rules to finish.
-	state = state(p, token{tokenNewline, "\n", l.line, l.col})
+	state = state(p, token{tokenNewline, "\n", l.line, l.col, ""})
 
 	p.rules.vars["mkfiledir"] = oldmkfiledir
 
@@ -155,16 +157,26 @@ func parseRedirInclude(p *parser, t token) parserStateFun {
 		for i := range p.tokenbuf {
 			filename += p.tokenbuf[i].val
 		}
+		inc := include{name: filename, file: p.name, line: p.tokenbuf[0].line}
 		file, err := os.Open(filename)
-		if err != nil {
+		if os.IsNotExist(err) {
+			// it may be made by a rule, after which everything is reparsed
+			inc.missing = true
+			p.rules.includes = append(p.rules.includes, inc)
+			p.clear()
+			return parseTopLevel
+		} else if err != nil {
 			p.basicErrorAtToken(fmt.Sprintf("cannot open %s", filename), p.tokenbuf[0])
 		}
 		input, _ := ioutil.ReadAll(file)
+		file.Close()
+		p.rules.includes = append(p.rules.includes, inc)
 
 		path, err := filepath.Abs(filename)
 		if err != nil {
 			mkError("unable to find mkfile's absolute path")
 		}
+		p.rules.files = append(p.rules.files, path)
 
 		parseInto(string(input), filename, p.rules, path)
 
@@ -282,6 +294,9 @@ func parsePrereqs(p *parser, t token) parserStateFun {
 func parseRecipe(p *parser, t token) parserStateFun {
 	// Assemble the rule!
 	r := rule{}
+	r.file = p.name
+	r.line = p.tokenbuf[0].line
+	r.doc = p.tokenbuf[0].doc
 
 	// find one or two colons
 	i := 0
@@ -307,6 +322,15 @@ func parseRecipe(p *parser, t token) parserStateFun {
 		if r.attributes.regex {
 			r.ismeta = true
 		}
+
+		// the include path in effect where the rule is defined
+		if r.attributes.scanIncludes {
+			r.incpath = p.rules.vars["includepath"]
+		}
+
+		if r.attributes.cached && !r.attributes.virtual {
+			p.basicErrorAtToken("the C attribute requires the V attribute", p.tokenbuf[i+1])
+		}
 	} else {
 		j = i
 	}
@@ -351,11 +375,36 @@ func parseRecipe(p *parser, t token) parserStateFun {
 		}
 	}
 
-	// prereqs
+	// prereqs, with any after a '|' being order-only
 	r.prereqs = make([]string, 0)
+	prereqs := &r.prereqs
 	for k := j + 1; k < len(p.tokenbuf); k++ {
-		exparts := expand(p.tokenbuf[k].val, p.rules.vars, true)
-		r.prereqs = append(r.prereqs, exparts...)
+		if p.tokenbuf[k].val == "|" {
+			if r.orderonly != nil {
+				p.basicErrorAtToken("more than one '|' in a rule's prerequisites", p.tokenbuf[k])
+			}
+			r.orderonly = make([]string, 0)
+			prereqs = &r.orderonly
+			continue
+		}
+
+		// optional prerequisites keep their '?' until the graph is built
+		word := p.tokenbuf[k].val
+		optional := strings.HasPrefix(word, "?")
+		if optional {
+			word = word[1:]
+		}
+
+		exparts := expand(word, p.rules.vars, true)
+		if hasGlob(word) {
+			exparts = expandGlobs(exparts, filepath.Dir(p.path))
+		}
+		if optional {
+			for i := range exparts {
+				exparts[i] = "?" + exparts[i]
+			}
+		}
+		*prereqs = append(*prereqs, exparts...)
 	}
 
 	if t.typ == tokenRecipe {
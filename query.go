@@ -0,0 +1,282 @@
+// Queries on the graph, answered without building anything.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Look up a node that must be in the graph.
+func (g *graph) mustNode(name string) *node {
+	u, ok := g.nodes[name]
+	if !ok || u == g.root {
+		mkError(fmt.Sprintf("mk: %s is not in the graph", name))
+	}
+	return u
+}
+
+// Most paths -why prints, since a graph with many diamonds can have
+// exponentially many.
+const maxWhyPaths = 100
+
+// Print the paths from a requested target to the named node, one per line, up
+// to maxWhyPaths of them.
+func (g *graph) why(w io.Writer, name string) {
+	v := g.mustNode(name)
+
+	// which nodes lead to v, so paths that don't are never followed
+	reaches := make(map[*node]bool)
+	var leads func(u *node) bool
+	leads = func(u *node) bool {
+		if r, ok := reaches[u]; ok {
+			return r
+		}
+		r := u == v
+		reaches[u] = r
+		for i := range u.prereqs {
+			if u.prereqs[i].v != nil && leads(u.prereqs[i].v) {
+				r = true
+			}
+		}
+		reaches[u] = r
+		return r
+	}
+
+	path := make([]string, 0)
+	printed := 0
+	truncated := false
+	var walk func(u *node)
+	walk = func(u *node) {
+		if printed == maxWhyPaths {
+			truncated = true
+			return
+		}
+		path = append(path, u.name)
+		if u == v {
+			fmt.Fprintln(w, strings.Join(path, " -> "))
+			printed++
+		} else {
+			seen := make(map[*node]bool)
+			for i := range u.prereqs {
+				x := u.prereqs[i].v
+				if x != nil && !seen[x] && leads(x) {
+					seen[x] = true
+					walk(x)
+				}
+			}
+		}
+		path = path[:len(path)-1]
+	}
+
+	for i := range g.root.prereqs {
+		if x := g.root.prereqs[i].v; x != nil && leads(x) {
+			walk(x)
+		}
+	}
+	if truncated {
+		fmt.Fprintf(w, "mk: more paths lead to %s, only the first %d are shown\n", v.name, maxWhyPaths)
+	}
+}
+
+// Print the transitive prerequisites of the named node, one per line.
+func (g *graph) deps(w io.Writer, name string) {
+	u := g.mustNode(name)
+	seen := make(map[*node]bool)
+	var visit func(u *node)
+	visit = func(u *node) {
+		for i := range u.prereqs {
+			v := u.prereqs[i].v
+			if v != nil && !seen[v] {
+				seen[v] = true
+				visit(v)
+			}
+		}
+	}
+	visit(u)
+	printNodeNames(w, seen)
+}
+
+// Print every target that transitively depends on the named node, one per
+// line.
+func (g *graph) rdeps(w io.Writer, name string) {
+	v := g.mustNode(name)
+
+	// reverse the edges reachable from the root
+	dependents := make(map[*node][]*node)
+	seen := map[*node]bool{g.root: true}
+	stack := []*node{g.root}
+	for len(stack) > 0 {
+		u := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for i := range u.prereqs {
+			x := u.prereqs[i].v
+			if x == nil {
+				continue
+			}
+			dependents[x] = append(dependents[x], u)
+			if !seen[x] {
+				seen[x] = true
+				stack = append(stack, x)
+			}
+		}
+	}
+
+	found := make(map[*node]bool)
+	stack = []*node{v}
+	for len(stack) > 0 {
+		u := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, x := range dependents[u] {
+			if x != g.root && !found[x] {
+				found[x] = true
+				stack = append(stack, x)
+			}
+		}
+	}
+	printNodeNames(w, found)
+}
+
+// Print how the named target would be built: the rule chosen, its stems,
+// prerequisites, and expanded recipe, and any candidate rules that were pruned,
+// and why.
+func (g *graph) which(w io.Writer, name string) {
+	u := g.mustNode(name)
+	e := u.ruleEdge()
+	if len(u.ambiguous) > 0 {
+		fmt.Fprintf(w, "%s: ambiguous, with differing recipes from:\n", u.name)
+		for _, r := range u.ambiguous {
+			fmt.Fprintf(w, "    %s\n", u.describeRule(r))
+		}
+		fmt.Fprintf(w, "add an explicit rule for %s, or give one rule a higher priority with the W attribute\n", u.name)
+		return
+	} else if e == nil {
+		if u.exists {
+			fmt.Fprintf(w, "%s: no rule, the file exists\n", u.name)
+		} else {
+			fmt.Fprintf(w, "%s: no rule, and the file doesn't exist\n", u.name)
+		}
+	} else {
+		fmt.Fprintf(w, "%s: %s:%d: %s\n", u.name, e.r.file, e.r.line, e.r)
+		if e.r.attributes.regex {
+			for i := range e.matches {
+				fmt.Fprintf(w, "    $stem%d = %s\n", i, e.matches[i])
+			}
+		} else if e.r.ismeta {
+			fmt.Fprintf(w, "    $stem = %s\n", e.stem)
+		}
+
+		prereqs := make([]string, 0)
+		for i := range u.prereqs {
+			f := u.prereqs[i]
+			if f.r == e.r && f.v != nil && !f.orderonly {
+				prereqs = append(prereqs, f.v.name)
+			}
+		}
+		fmt.Fprintf(w, "    $prereq = %s\n", strings.Join(prereqs, " "))
+
+		for i := range u.prereqs {
+			f := u.prereqs[i]
+			if f.r == e.r && f.v != nil && f.orderonly {
+				fmt.Fprintf(w, "    order-only %s\n", f.v.name)
+			}
+		}
+
+		for i := range u.prereqs {
+			f := u.prereqs[i]
+			if f.r != e.r && f.v != nil {
+				fmt.Fprintf(w, "    also depends on %s, from %s:%d\n", f.v.name, f.r.file, f.r.line)
+			}
+		}
+
+		if e.r.recipe != "" {
+			fmt.Fprintf(w, "    recipe:\n        ")
+			printIndented(w, strings.TrimRight(expandRecipe(u.name, u, e), "\n"), 8)
+			fmt.Fprintln(w)
+		}
+	}
+
+	// a rule may have generated several pruned edges, so group them
+	rules := make([]*rule, 0)
+	reasons := make(map[*rule][]string)
+	for _, f := range u.pruned {
+		if _, ok := reasons[f.r]; !ok {
+			rules = append(rules, f.r)
+		}
+		reasons[f.r] = append(reasons[f.r], f.reason)
+	}
+	for _, r := range rules {
+		fmt.Fprintf(w, "pruned %s:%d: %s\n", r.file, r.line, r)
+		seen := make(map[string]bool)
+		for _, reason := range reasons[r] {
+			if !seen[reason] {
+				seen[reason] = true
+				fmt.Fprintf(w, "    %s\n", reason)
+			}
+		}
+	}
+}
+
+// Print the names of a set of nodes in sorted order, one per line.
+func printNodeNames(w io.Writer, us map[*node]bool) {
+	names := make([]string, 0, len(us))
+	for u := range us {
+		names = append(names, u.name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(w, name)
+	}
+}
+
+// List the targets of non-meta rules, virtual ones first, with where they're
+// defined and the comments documenting them.
+func (rs *ruleSet) list(w io.Writer) {
+	seen := make(map[string]bool)
+	listed := make([]*rule, 0)
+	targets := make([]string, 0)
+	for _, virtual := range []bool{true, false} {
+		for i := range rs.rules {
+			r := &rs.rules[i]
+			if r.ismeta || r.attributes.virtual != virtual {
+				continue
+			}
+			for j := range r.targets {
+				target := r.targets[j].spat
+				if !seen[target] {
+					seen[target] = true
+					listed = append(listed, r)
+					targets = append(targets, target)
+				}
+			}
+		}
+	}
+
+	// a target's description may come from any of its rules
+	docs := make(map[string]*rule)
+	for i := range rs.rules {
+		r := &rs.rules[i]
+		for j := range r.targets {
+			if docs[r.targets[j].spat] == nil && r.doc != "" {
+				docs[r.targets[j].spat] = r
+			}
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for i, target := range targets {
+		r := listed[i]
+		if docs[target] != nil {
+			r = docs[target]
+		}
+		lines := strings.Split(strings.TrimRight(r.doc, "\n"), "\n")
+		fmt.Fprintf(tw, "%s\t%s:%d\t%s\n", target, r.file, r.line, lines[0])
+		for _, line := range lines[1:] {
+			fmt.Fprintf(tw, "\t\t%s\n", line)
+		}
+	}
+	tw.Flush()
+}
@@ -9,7 +9,9 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"time"
 	"unicode/utf8"
 )
 
@@ -62,8 +64,8 @@ func printIndented(out io.Writer, s string, ind int) {
 	}
 }
 
-// Execute a recipe.
-func dorecipe(target string, u *node, e *edge, dryrun bool) bool {
+// Expand a recipe's variables for the given target.
+func expandRecipe(target string, u *node, e *edge) string {
 	vars := make(map[string][]string)
 	vars["target"] = []string{target}
 	if e.r.ismeta {
@@ -82,13 +84,53 @@ func dorecipe(target string, u *node, e *edge, dryrun bool) bool {
 
 	prereqs := make([]string, 0)
 	for i := range u.prereqs {
-		if u.prereqs[i].r == e.r && u.prereqs[i].v != nil {
-			prereqs = append(prereqs, u.prereqs[i].v.name)
+		f := u.prereqs[i]
+		if f.r == e.r && f.v != nil && !f.orderonly {
+			prereqs = append(prereqs, f.v.name)
 		}
 	}
 	vars["prereq"] = prereqs
 
-	input := expandRecipeSigils(e.r.recipe, vars)
+	return expandRecipeSigils(e.r.recipe, vars)
+}
+
+// Create the parent directories of the targets a recipe will build, returning
+// false if that fails.
+func mkTargetDirs(u *node, e *edge) bool {
+	if e.r.attributes.virtual {
+		return true
+	}
+
+	for _, target := range recipeTargets(u, e) {
+		err := os.MkdirAll(filepath.Dir(target), 0755)
+		if err != nil {
+			mkPrintError(fmt.Sprintf("mk: unable to create directory for %s: %s", target, err))
+			return false
+		}
+	}
+	return true
+}
+
+// Return the targets a recipe will build, as far as they're known: those of a
+// suffix rule are named using the stem, but only the matched target of a
+// regular expression rule is known.
+func recipeTargets(u *node, e *edge) []string {
+	targets := []string{u.name}
+	if !e.r.attributes.regex {
+		for i := range e.r.targets {
+			if e.r.targets[i].issuffix {
+				targets = append(targets, expandSuffixes(e.r.targets[i].spat, e.stem))
+			} else {
+				targets = append(targets, e.r.targets[i].spat)
+			}
+		}
+	}
+	return targets
+}
+
+// Execute a recipe.
+func dorecipe(target string, u *node, e *edge, dryrun bool) bool {
+	input := expandRecipe(target, u, e)
 	sh := "sh"
 	args := []string{}
 
@@ -97,18 +139,66 @@ func dorecipe(target string, u *node, e *edge, dryrun bool) bool {
 		args = e.r.shell[1:]
 	}
 
-	mkPrintRecipe(target, input, e.r.attributes.quiet)
+	var hash string
+	if e.r.attributes.cached {
+		hash = hashInputs(u, sh, args, input)
+		if replayCached(target, hash, !dryrun) {
+			return true
+		}
+	}
+
+	if skipfailed {
+		prevhash, ok := failedHash(target)
+		if ok && prevhash == hashInputs(u, sh, args, input) {
+			mkPrintError(fmt.Sprintf("mk: %s failed before with identical inputs", target))
+			return false
+		}
+	}
+
+	mkPrintRecipe(target, input, e.r.attributes.quiet || quietall)
+	passTurn(u)
 
 	if dryrun {
 		return true
 	}
 
-	_, success := subprocess(
-		sh,
-		args,
-		input,
-		false)
+	// cached rules have their output copied as it's written
+	stdout, stderr := os.Stdout, os.Stderr
+	var tee *teeOutput
+	if e.r.attributes.cached {
+		tee = newTeeOutput()
+		stdout, stderr = tee.stdout, tee.stderr
+	}
+
+	start := time.Now()
+	var success bool
+	if traceaccess {
+		var acc *fileAccesses
+		success, acc = tracedSubprocess(sh, args, input, stdout, stderr)
+		if success {
+			checkAccesses(u, e, acc)
+		}
+	} else {
+		_, success = subprocessTo(
+			sh,
+			args,
+			input,
+			false,
+			stdout,
+			stderr)
+	}
 
+	if tee != nil {
+		tee.wait()
+		if success {
+			saveCached(hash, tee)
+		}
+	}
+
+	noteFailure(u, sh, args, input, success)
+	if success {
+		noteDuration(target, time.Since(start))
+	}
 	return success
 }
 
@@ -129,6 +219,17 @@ func subprocess(program string,
 	args []string,
 	input string,
 	capture_out bool) (string, bool) {
+	return subprocessTo(program, args, input, capture_out, os.Stdout, os.Stderr)
+}
+
+// Execute a subprocess as above, with its standard out, unless captured, and
+// error going to the given files.
+func subprocessTo(program string,
+	args []string,
+	input string,
+	capture_out bool,
+	stdout *os.File,
+	stderr *os.File) (string, bool) {
 	program_path, err := exec.LookPath(program)
 	if err != nil {
 		log.Fatal(err)
@@ -142,7 +243,7 @@ func subprocess(program string,
 		log.Fatal(err)
 	}
 
-	attr := os.ProcAttr{Files: []*os.File{stdin_pipe_read, os.Stdout, os.Stderr}}
+	attr := os.ProcAttr{Files: []*os.File{stdin_pipe_read, stdout, stderr}}
 
 	output := make([]byte, 0)
 	capture_done := make(chan bool)
@@ -191,7 +292,7 @@ func subprocess(program string,
 
 	state, err := proc.Wait()
 
-	if attr.Files[1] != os.Stdout {
+	if capture_out {
 		attr.Files[1].Close()
 	}
 
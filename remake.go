@@ -0,0 +1,90 @@
+// Remaking included mkfiles. An included file that doesn't exist is skipped
+// while parsing, then any included file with a rule is brought up to date
+// before anything else is built, and if one changed, the mkfile is parsed again
+// from scratch.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// How many times included files may change before giving up.
+const maxRemakes = 10
+
+// A file included with '<'.
+type include struct {
+	name    string // as written
+	file    string // mkfile including it
+	line    int
+	missing bool // didn't exist when parsed
+}
+
+// Bring the files included by a parsed mkfile up to date, returning the rule
+// set parsed once none of them change.
+func remakeMkfiles(mkfilepath string, rs *ruleSet) *ruleSet {
+	for n := 0; len(rs.includes) > 0; n++ {
+		if n == maxRemakes {
+			mkError(fmt.Sprintf("mk: included mkfiles still changing after being remade %d times", n))
+		}
+		if !remakeIncludes(rs) {
+			break
+		}
+		rs = readMkfile(mkfilepath)
+	}
+	return rs
+}
+
+// Make the included files that have rules, returning true if any changed.
+func remakeIncludes(rs *ruleSet) bool {
+	names := make([]string, len(rs.includes))
+	before := make(map[string]time.Time, len(rs.includes))
+	for i, inc := range rs.includes {
+		names[i] = inc.name
+		before[inc.name] = includeTime(inc.name)
+	}
+
+	grs := rs.clone()
+	addRootRule(grs, names)
+	g := buildgraph(grs, "")
+
+	for _, inc := range rs.includes {
+		if inc.missing && len(g.nodes[inc.name].prereqs) == 0 {
+			mkError(fmt.Sprintf("%s:%d: syntax error: cannot open %s", inc.file, inc.line, inc.name))
+		}
+	}
+
+	// -a would remake them forever
+	all := rebuildall
+	rebuildall = false
+	g.numberTurns([]*node{g.root})
+	mkNode(g, g.root, false, true)
+	rebuildall = all
+
+	changed := false
+	for _, inc := range rs.includes {
+		if g.nodes[inc.name].status == nodeStatusFailed {
+			mkError(fmt.Sprintf("mk: unable to remake included mkfile %s", inc.name))
+		}
+		after := includeTime(inc.name)
+		if inc.missing && after.IsZero() {
+			mkError(fmt.Sprintf("%s:%d: syntax error: cannot open %s", inc.file, inc.line, inc.name))
+		}
+		if !after.Equal(before[inc.name]) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Modification time of an included file, or the zero time if it doesn't
+// exist.
+func includeTime(name string) time.Time {
+	info, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
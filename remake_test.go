@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// Parse the mkfile in the current directory, remaking what it includes,
+// returning the rule set or the error raised.
+func remakeParse() (rs *ruleSet, msg string) {
+	quiet, allowed := quietall, subprocsAllowed
+	quietall, subprocsAllowed = true, 1
+	defer func() { quietall, subprocsAllowed = quiet, allowed }()
+
+	msg = catchError(func() { rs = parseMkfile("mkfile", true) })
+	return rs, msg
+}
+
+// An included mkfile with a rule is brought up to date first, and the mkfile
+// parsed again if it changed.
+func TestRemakeIncludes(t *testing.T) {
+	mkfile := "<vars.mk\nvars.mk: vars.in\n\techo vars.mk >> log; RECIPE\n"
+	tests := []struct {
+		recipe string
+		files  map[string]string
+		ages   map[string]int
+		name   string // $NAME once parsed
+		built  string
+		err    string
+	}{
+		// missing
+		{"cp vars.in vars.mk", map[string]string{"vars.in": "NAME=new\n"}, nil,
+			"new", "vars.mk", ""},
+		// out of date
+		{"cp vars.in vars.mk", map[string]string{"vars.in": "NAME=new\n", "vars.mk": "NAME=old\n"},
+			map[string]int{"vars.mk": 2, "vars.in": 1}, "new", "vars.mk", ""},
+		// up to date
+		{"cp vars.in vars.mk", map[string]string{"vars.in": "NAME=new\n", "vars.mk": "NAME=old\n"},
+			map[string]int{"vars.mk": 1, "vars.in": 2}, "old", "", ""},
+		// left alone by its recipe, so not parsed again
+		{"true", map[string]string{"vars.in": "NAME=new\n", "vars.mk": "NAME=old\n"},
+			map[string]int{"vars.mk": 2, "vars.in": 1}, "old", "vars.mk", ""},
+		// missing, and its recipe doesn't make it
+		{"true", map[string]string{"vars.in": "NAME=new\n"}, nil,
+			"", "vars.mk", "mkfile:1: syntax error: cannot open vars.mk"},
+	}
+	for _, test := range tests {
+		files := map[string]string{"mkfile": strings.Replace(mkfile, "RECIPE", test.recipe, 1)}
+		for name, contents := range test.files {
+			files[name] = contents
+		}
+		inTempDir(t, files)
+		setAge(t, test.ages)
+
+		rs, msg := remakeParse()
+		if msg != test.err {
+			t.Errorf("%q with %v: error %q, want %q", test.recipe, test.files, msg, test.err)
+			continue
+		}
+		if rs != nil && strings.Join(rs.vars["NAME"], " ") != test.name {
+			t.Errorf("%q with %v: NAME = %q, want %q", test.recipe, test.files,
+				strings.Join(rs.vars["NAME"], " "), test.name)
+		}
+		log, _ := ioutil.ReadFile("log")
+		if got := strings.Join(strings.Fields(string(log)), " "); got != test.built {
+			t.Errorf("%q with %v: built %q, want %q", test.recipe, test.files, got, test.built)
+		}
+	}
+}
+
+// An included mkfile that keeps changing is given up on.
+func TestRemakeForever(t *testing.T) {
+	mkfile := "<count.mk\ncount.mk:V:\n\techo '#' >> count.mk\n"
+	inTempDir(t, map[string]string{"mkfile": mkfile, "count.mk": ""})
+
+	_, msg := remakeParse()
+	want := "mk: included mkfiles still changing after being remade 10 times"
+	if msg != want {
+		t.Errorf("error %q, want %q", msg, want)
+	}
+}
@@ -0,0 +1,147 @@
+// Rules with the T attribute check whether their recipe actually changed the
+// target, and if not, what depends on the target isn't rebuilt. Since the
+// target is then older than its prerequisites, the time it was last found up
+// to date is remembered, so the recipe doesn't run again on every build. A
+// target rewritten with the same contents is left with its new modification
+// time, but mk remembers and goes on using the old one.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What's remembered about a target.
+type restatEntry struct {
+	uptodate time.Time // newest prerequisite it was found up to date with
+	mtime    time.Time // modification time a recipe rewrote it with, if any
+	t        time.Time // time to use instead, while it has that mtime
+}
+
+// Targets mapped to what's remembered about them, as nanoseconds since the
+// epoch, or 0 if unknown.
+var restatTimes = newStateFile("restat", "restat times")
+
+// Return what's remembered about a target, if anything.
+func restatLookup(target string) (restatEntry, bool) {
+	value, ok := restatTimes.get(target)
+	if !ok {
+		return restatEntry{}, false
+	}
+	fields := strings.Split(value, "\t")
+	var ts [3]time.Time
+	for i := 0; i < len(ts) && i < len(fields); i++ {
+		if ns, err := strconv.ParseInt(fields[i], 10, 64); err == nil && ns != 0 {
+			ts[i] = time.Unix(0, ns)
+		}
+	}
+	return restatEntry{ts[0], ts[1], ts[2]}, true
+}
+
+// Remember what's known about a target.
+func restatRecord(target string, e restatEntry) {
+	restatTimes.set(target, fmt.Sprintf("%d\t%d\t%d", unixNano(e.uptodate),
+		unixNano(e.mtime), unixNano(e.t)))
+}
+
+// A target's modification time and a hash of its contents, from before its
+// recipe ran.
+type targetState struct {
+	exists bool
+	mtime  time.Time
+	t      time.Time // mtime, or the time remembered in its place
+	hash   string    // empty if the target isn't a readable file
+}
+
+// Record the state of a target.
+func statTarget(name string) targetState {
+	info, err := os.Stat(name)
+	if err != nil {
+		return targetState{}
+	}
+	s := targetState{exists: true, mtime: info.ModTime()}
+	s.t = restatModTime(name, s.mtime)
+
+	file, err := os.Open(name)
+	if err != nil || info.IsDir() {
+		return s
+	}
+	defer file.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err == nil {
+		s.hash = hex.EncodeToString(h.Sum(nil))
+	}
+	return s
+}
+
+// True if a recipe left its target as it was. A target rewritten with the same
+// contents keeps its old time, for as long as it isn't modified again, so it
+// stays unchanged as far as later builds are concerned too.
+func restatUnchanged(u *node, before targetState) bool {
+	if !before.exists || !u.exists {
+		return false
+	}
+	if u.t.Equal(before.t) {
+		return true
+	}
+
+	after := statTarget(u.name)
+	if after.hash == "" || after.hash != before.hash {
+		return false
+	}
+
+	e, _ := restatLookup(u.name)
+	e.mtime, e.t = after.mtime, before.t
+	restatRecord(u.name, e)
+
+	u.t = before.t
+	return true
+}
+
+// Return the time to use for a target with the given modification time: the
+// one remembered in its place, if a recipe rewrote it with the same contents
+// and it hasn't changed since.
+func restatModTime(target string, mtime time.Time) time.Time {
+	if e, ok := restatLookup(target); ok && !e.mtime.IsZero() && e.mtime.Equal(mtime) {
+		return e.t
+	}
+	return mtime
+}
+
+// Return the time a target should be compared with its prerequisites as: its
+// modification time, or when it was last found up to date, if later.
+func restatTime(u *node) time.Time {
+	if e, ok := restatLookup(u.name); ok && u.t.Before(e.uptodate) {
+		return e.uptodate
+	}
+	return u.t
+}
+
+// Remember that a target is up to date with prerequisites as new as t, or
+// forget it if t is zero.
+func noteRestat(target string, t time.Time) {
+	if t.IsZero() {
+		restatTimes.remove(target)
+		return
+	}
+	e, _ := restatLookup(target)
+	if !e.uptodate.Equal(t) {
+		e.uptodate = t
+		restatRecord(target, e)
+	}
+}
+
+// Return t in nanoseconds since the epoch, or 0 if it's zero.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
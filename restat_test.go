@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// What depends on a T target is only rebuilt when its recipe changes it, and
+// the target's own modification time is left as the recipe left it.
+func TestRestat(t *testing.T) {
+	mkfile := "out: gen.h\n\techo out >> log; touch out\n" +
+		"gen.h:T: VERSION\n\techo gen.h >> log; GEN\n"
+	inTempDir(t, map[string]string{"VERSION": "", "gen.h": "1\n", "out": ""})
+	age := 8
+	setAge(t, map[string]int{"gen.h": 10, "out": 9, "VERSION": age})
+
+	steps := []struct {
+		gen     string // the recipe's command
+		touch   bool   // whether VERSION is made newer first
+		built   string
+		mtimeup bool // whether gen.h's modification time should have changed
+	}{
+		// left alone
+		{"true", true, "gen.h", false},
+		// up to date, though older than VERSION
+		{"true", false, "", false},
+		// rewritten with the same contents
+		{"echo 1 > gen.h", true, "gen.h", true},
+		{"echo 1 > gen.h", false, "", false},
+		// changed
+		{"echo 2 > gen.h", true, "gen.h out", true},
+		{"echo 2 > gen.h", false, "", false},
+	}
+	for i, step := range steps {
+		os.Remove("log")
+		if step.touch {
+			// still in the past, so anything the recipe writes is newer
+			age--
+			setAge(t, map[string]int{"VERSION": age})
+		}
+		before, err := os.Stat("gen.h")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		g := testGraph(t, strings.Replace(mkfile, "GEN", step.gen, 1), "out")
+		if got := strings.Join(buildLog(t, g, 1), " "); got != step.built {
+			t.Errorf("step %d: built %q, want %q", i, got, step.built)
+		}
+		saveState()
+		for _, s := range stateFiles {
+			s.reset()
+		}
+
+		after, err := os.Stat("gen.h")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if up := !after.ModTime().Equal(before.ModTime()); up != step.mtimeup {
+			t.Errorf("step %d: gen.h modification time changed %v, want %v", i, up, step.mtimeup)
+		}
+	}
+
+	contents, _ := ioutil.ReadFile("gen.h")
+	if string(contents) != "2\n" {
+		t.Errorf("gen.h contains %q, want %q", contents, "2\n")
+	}
+}
@@ -7,19 +7,31 @@ package main
 import (
 	"fmt"
 	"regexp"
+	"regexp/syntax"
+	"sort"
+	"strconv"
+	"strings"
 	"unicode/utf8"
 )
 
 type attribSet struct {
-	delFailed       bool // delete targets when the recipe fails
-	nonstop         bool // don't stop if the recipe fails
-	forcedTimestamp bool // update timestamp whether the recipe does or not
-	nonvirtual      bool // a meta-rule that will only match files
-	quiet           bool // don't print the recipe
-	regex           bool // regular expression meta-rule
-	update          bool // treat the targets as if they were updated
-	virtual         bool // rule is virtual (does not match files)
-	exclusive       bool // don't execute concurrently with any other rule
+	delFailed       bool   // delete targets when the recipe fails
+	nonstop         bool   // don't stop if the recipe fails
+	forcedTimestamp bool   // update timestamp whether the recipe does or not
+	nonvirtual      bool   // a meta-rule that will only match files
+	quiet           bool   // don't print the recipe
+	regex           bool   // regular expression meta-rule
+	update          bool   // treat the targets as if they were updated
+	virtual         bool   // rule is virtual (does not match files)
+	exclusive       bool   // don't execute concurrently with any other rule
+	cached          bool   // replay a virtual rule's output if its inputs are unchanged
+	mkdirs          bool   // create the parent directories of targets
+	keep            bool   // never treat the targets as intermediate files
+	restat          bool   // check whether the recipe actually changed the target
+	scanIncludes    bool   // scan prerequisites for #include "..." directives
+	dyndep          string // file listing more prerequisites, read before the recipe runs
+	priority        int    // precedence among meta-rules matching the same target
+	limit           int    // times a meta-rule may be applied in a chain, if not the default
 }
 
 // Error parsing an attribute
@@ -48,17 +60,225 @@ func (p *pattern) match(target string) []string {
 	return nil
 }
 
+// Literal text that any target matching the pattern must begin and end with.
+func (p *pattern) literals() (string, string) {
+	if p.issuffix {
+		idx := strings.IndexRune(p.spat, '%')
+		return p.spat[:idx], p.spat[idx+1:]
+	}
+	if p.rpat == nil {
+		return p.spat, ""
+	}
+
+	re, err := syntax.Parse(p.rpat.String(), syntax.Perl)
+	if err != nil {
+		return "", ""
+	}
+	re = re.Simplify()
+	subs := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		subs = re.Sub
+	}
+
+	// anchors match nothing, so can be skipped over
+	literal := func(re *syntax.Regexp) (string, bool) {
+		switch {
+		case re.Op == syntax.OpLiteral && re.Flags&syntax.FoldCase == 0:
+			return string(re.Rune), true
+		case re.Op == syntax.OpBeginText || re.Op == syntax.OpEndText:
+			return "", true
+		}
+		return "", false
+	}
+
+	prefix, suffix := "", ""
+	i := 0
+	for ; i < len(subs); i++ {
+		lit, ok := literal(subs[i])
+		if !ok {
+			break
+		}
+		prefix += lit
+	}
+	for j := len(subs) - 1; j >= i; j-- {
+		lit, ok := literal(subs[j])
+		if !ok {
+			break
+		}
+		suffix = lit + suffix
+	}
+	return prefix, suffix
+}
+
+// A meta-rule's target pattern, with the literal text matching targets begin
+// and end with.
+type metaPattern struct {
+	rule   int    // index into the rule set's rules
+	target int    // index into the rule's targets
+	prefix string // literal prefix
+	suffix string // literal suffix
+}
+
+// Meta-rule patterns indexed by literal suffix, so a target is only matched
+// against patterns that plausibly match it.
+type metaIndex struct {
+	bysuffix map[string][]metaPattern
+	lengths  []int         // distinct suffix lengths, in increasing order
+	all      []metaPattern // every pattern, in the order they are defined
+}
+
+// True if meta-rules are looked up by their literal suffixes, rather than
+// every one being tried against each target. Only how fast graphs are built
+// depends on it.
+var metaIndexed bool = true
+
+// Index the meta-rules in a rule set.
+func (rs *ruleSet) indexMeta() *metaIndex {
+	mi := &metaIndex{bysuffix: make(map[string][]metaPattern)}
+	seen := make(map[int]bool)
+	for k := range rs.rules {
+		r := &rs.rules[k]
+
+		// skip rules that have no effect
+		if !r.ismeta || (r.recipe == "" && len(r.allPrereqs()) == 0) {
+			continue
+		}
+
+		for j := range r.targets {
+			prefix, suffix := r.targets[j].literals()
+			p := metaPattern{k, j, prefix, suffix}
+			mi.bysuffix[suffix] = append(mi.bysuffix[suffix], p)
+			mi.all = append(mi.all, p)
+			if !seen[len(suffix)] {
+				seen[len(suffix)] = true
+				mi.lengths = append(mi.lengths, len(suffix))
+			}
+		}
+	}
+	sort.Ints(mi.lengths)
+	return mi
+}
+
+// Return the patterns that may match a target, in the order they are defined.
+func (mi *metaIndex) candidates(target string) []metaPattern {
+	if !metaIndexed {
+		return mi.all
+	}
+
+	cands := make([]metaPattern, 0)
+	for _, n := range mi.lengths {
+		if n > len(target) {
+			break
+		}
+		for _, p := range mi.bysuffix[target[len(target)-n:]] {
+			if len(target) >= len(p.prefix)+len(p.suffix) &&
+				strings.HasPrefix(target, p.prefix) {
+				cands = append(cands, p)
+			}
+		}
+	}
+
+	sort.Slice(cands, func(i, j int) bool {
+		if cands[i].rule != cands[j].rule {
+			return cands[i].rule < cands[j].rule
+		}
+		return cands[i].target < cands[j].target
+	})
+	return cands
+}
+
+// True if a chain of rules could apply the same rule more than once, in which
+// case application limits decide which rules apply. That takes a cycle of
+// rules, each with a prerequisite that could be the target of the next.
+func (rs *ruleSet) chainsRecur(mi *metaIndex) bool {
+	concrete := make([]string, 0, len(rs.targetrules))
+	for name := range rs.targetrules {
+		concrete = append(concrete, name)
+	}
+	metas := make([]metaPattern, 0)
+	for _, ps := range mi.bysuffix {
+		metas = append(metas, ps...)
+	}
+
+	// the rules that could make a rule's prerequisites
+	feeds := func(k int) []int {
+		r := &rs.rules[k]
+		next := make([]int, 0)
+		for _, prereq := range r.allPrereqs() {
+			prereq = strings.TrimPrefix(prereq, "?")
+
+			var prefix, suffix string
+			if r.ismeta && !r.attributes.regex && strings.ContainsRune(prereq, '%') {
+				prefix = prereq[:strings.IndexRune(prereq, '%')]
+				suffix = prereq[strings.LastIndex(prereq, "%")+1:]
+			} else if r.attributes.regex && strings.ContainsRune(prereq, '$') {
+				prefix = prereq[:strings.IndexRune(prereq, '$')]
+			} else {
+				next = append(next, rs.targetrules[prereq]...)
+				for _, c := range mi.candidates(prereq) {
+					next = append(next, c.rule)
+				}
+				continue
+			}
+
+			// a prerequisite that's still a pattern could be any name with
+			// its literal prefix and suffix
+			for _, name := range concrete {
+				if len(name) >= len(prefix)+len(suffix) &&
+					strings.HasPrefix(name, prefix) && strings.HasSuffix(name, suffix) {
+					next = append(next, rs.targetrules[name]...)
+				}
+			}
+			for _, c := range metas {
+				if (strings.HasPrefix(prefix, c.prefix) || strings.HasPrefix(c.prefix, prefix)) &&
+					(strings.HasSuffix(suffix, c.suffix) || strings.HasSuffix(c.suffix, suffix)) {
+					next = append(next, c.rule)
+				}
+			}
+		}
+		return next
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(rs.rules))
+	var visit func(k int) bool
+	visit = func(k int) bool {
+		state[k] = visiting
+		for _, j := range feeds(k) {
+			if state[j] == visiting || (state[j] == unvisited && visit(j)) {
+				return true
+			}
+		}
+		state[k] = visited
+		return false
+	}
+	for k := range rs.rules {
+		if state[k] == unvisited && visit(k) {
+			return true
+		}
+	}
+	return false
+}
+
 // A single rule.
 type rule struct {
 	targets    []pattern // non-empty array of targets
 	attributes attribSet // rule attributes
 	prereqs    []string  // possibly empty prerequesites
+	orderonly  []string  // prerequisites that need only exist
 	shell      []string  // command used to execute the recipe
 	recipe     string    // recipe source
 	command    []string  // command attribute
 	ismeta     bool      // is this a meta rule
 	file       string    // file where the rule is defined
 	line       int       // line number on which the rule is defined
+	doc        string    // comment block preceding the rule
+	incpath    []string  // directories searched for included headers
+	scanned    *rule     // rule whose prerequisites' headers this rule lists
 }
 
 // Equivalent recipes.
@@ -80,12 +300,96 @@ func (r1 *rule) equivRecipe(r2 *rule) bool {
 	return true
 }
 
+// Attributes of a rule, as the letters used to give them in a mkfile.
+func (a *attribSet) letters() string {
+	letters := ""
+	flags := []struct {
+		set    bool
+		letter string
+	}{
+		{a.cached, "C"},
+		{a.delFailed, "D"},
+		{a.nonstop, "E"},
+		{a.forcedTimestamp, "N"},
+		{a.nonvirtual, "n"},
+		{a.quiet, "Q"},
+		{a.regex, "R"},
+		{a.update, "U"},
+		{a.virtual, "V"},
+		{a.exclusive, "X"},
+		{a.mkdirs, "M"},
+		{a.keep, "K"},
+		{a.restat, "T"},
+		{a.scanIncludes, "I"},
+	}
+	for _, f := range flags {
+		if f.set {
+			letters += f.letter
+		}
+	}
+	if a.priority != 0 {
+		letters += fmt.Sprintf("W%d", a.priority)
+	}
+	if a.limit != 0 {
+		letters += fmt.Sprintf("L%d", a.limit)
+	}
+	if a.dyndep != "" {
+		letters += "Y" + a.dyndep
+	}
+	return letters
+}
+
+// Return every prerequisite of a rule: ordinary ones, then order-only ones, then
+// its dyndep file, if it has one.
+func (r *rule) allPrereqs() []string {
+	prereqs := append(append([]string{}, r.prereqs...), r.orderonly...)
+	if r.attributes.dyndep != "" {
+		prereqs = append(prereqs, r.attributes.dyndep)
+	}
+	return prereqs
+}
+
+// Describe a rule as it would be written in a mkfile, without its recipe.
+func (r *rule) String() string {
+	targets := make([]string, len(r.targets))
+	for i := range r.targets {
+		targets[i] = r.targets[i].spat
+	}
+	s := strings.Join(targets, " ") + ":"
+	if letters := r.attributes.letters(); letters != "" {
+		s += letters + ":"
+	}
+	if len(r.prereqs) > 0 {
+		s += " " + strings.Join(r.prereqs, " ")
+	}
+	if len(r.orderonly) > 0 {
+		s += " | " + strings.Join(r.orderonly, " ")
+	}
+	return s
+}
+
 // A set of rules.
 type ruleSet struct {
 	vars  map[string][]string
 	rules []rule
 	// map a target to an array of indexes into rules
 	targetrules map[string][]int
+	// absolute paths of the mkfile and every file it included
+	files []string
+	// files included with '<', in order, including those that don't exist
+	includes []include
+}
+
+// Return a copy of a rule set, to which rules can be added without changing
+// the original.
+func (rs *ruleSet) clone() *ruleSet {
+	c := *rs
+	c.rules = append([]rule(nil), rs.rules...)
+	c.targetrules = make(map[string][]int, len(rs.targetrules)+1)
+	for k, v := range rs.targetrules {
+		c.targetrules[k] = v
+	}
+	return &c
 }
 
 // Read attributes for an array of strings, updating the rule.
@@ -96,10 +400,18 @@ func (r *rule) parseAttribs(inputs []string) *attribError {
 		for pos < len(input) {
 			c, w := utf8.DecodeRuneInString(input[pos:])
 			switch c {
+			case 'C':
+				r.attributes.cached = true
 			case 'D':
 				r.attributes.delFailed = true
 			case 'E':
 				r.attributes.nonstop = true
+			case 'I':
+				r.attributes.scanIncludes = true
+			case 'K':
+				r.attributes.keep = true
+			case 'M':
+				r.attributes.mkdirs = true
 			case 'N':
 				r.attributes.forcedTimestamp = true
 			case 'n':
@@ -108,12 +420,28 @@ func (r *rule) parseAttribs(inputs []string) *attribError {
 				r.attributes.quiet = true
 			case 'R':
 				r.attributes.regex = true
+			case 'T':
+				r.attributes.restat = true
 			case 'U':
 				r.attributes.update = true
 			case 'V':
 				r.attributes.virtual = true
 			case 'X':
 				r.attributes.exclusive = true
+			case 'W':
+				priority, end, err := parseAttribInt(input, pos+w)
+				if err != nil {
+					return &attribError{c}
+				}
+				r.attributes.priority = priority
+				pos = end - w
+			case 'L':
+				limit, end, err := parseAttribInt(input, pos+w)
+				if err != nil || limit < 1 {
+					return &attribError{c}
+				}
+				r.attributes.limit = limit
+				pos = end - w
 			case 'P':
 				if pos+w < len(input) {
 					r.command = append(r.command, input[pos+w:])
@@ -121,6 +449,18 @@ func (r *rule) parseAttribs(inputs []string) *attribError {
 				r.command = append(r.command, inputs[i+1:]...)
 				return nil
 
+			case 'Y':
+				file := input[pos+w:]
+				rest := inputs[i+1:]
+				if file == "" && len(rest) > 0 {
+					file, rest = rest[0], rest[1:]
+				}
+				if file == "" || len(rest) > 0 {
+					return &attribError{c}
+				}
+				r.attributes.dyndep = file
+				return nil
+
 			case 'S':
 				if pos+w < len(input) {
 					r.shell = append(r.shell, input[pos+w:])
@@ -139,6 +479,28 @@ func (r *rule) parseAttribs(inputs []string) *attribError {
 	return nil
 }
 
+// Read the integer following an attribute starting at pos, returning it and
+// the position following it.
+func parseAttribInt(input string, pos int) (int, int, error) {
+	end := pos
+	if end < len(input) && input[end] == '-' {
+		end++
+	}
+	for end < len(input) && isdigit(rune(input[end])) {
+		end++
+	}
+	n, err := strconv.Atoi(input[pos:end])
+	return n, end, err
+}
+
+// The maximum number of times a rule may be applied in a chain of rules.
+func (r *rule) maxApplications() int {
+	if r.attributes.limit > 0 {
+		return r.attributes.limit
+	}
+	return maxRuleCnt
+}
+
 // Add a rule to the rule set.
 func (rs *ruleSet) add(r rule) {
 	rs.rules = append(rs.rules, r)
@@ -207,7 +569,11 @@ func (rs *ruleSet) executeAssignment(ts []token) *assignmentError {
 	// expanded variables
 	vals := make([]string, 0)
 	for i := 0; i < len(input); i++ {
-		vals = append(vals, expand(input[i], rs.vars, true)...)
+		exparts := expand(input[i], rs.vars, true)
+		if hasGlob(input[i]) {
+			exparts = expandGlobs(exparts, rs.vars["mkfiledir"][0])
+		}
+		vals = append(vals, exparts...)
 	}
 
 	rs.vars[assignee] = vals
@@ -0,0 +1,146 @@
+// Rules with the I attribute have their prerequisites scanned for
+// #include "..." directives, and the headers found, and those they include in
+// turn, become prerequisites too. Headers are looked for next to the file
+// including them, then in the directories in $includepath. What each file
+// includes is kept between runs, and a file is only read again once its
+// modification time changes.
+
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Scanned files mapped to their modification time, in nanoseconds since the
+// epoch, and the names in their directives, separated by tabs.
+var scanEntries = newStateFile("includes", "scanned includes")
+
+var includeDirective = regexp.MustCompile(`^\s*#\s*include\s*"([^"]+)"`)
+
+// What has been found out about files while building a graph, so that each is
+// looked at once.
+type includeScanner struct {
+	exists   map[string]bool
+	includes map[string][]string
+	mutex    sync.Mutex
+}
+
+func newIncludeScanner() *includeScanner {
+	return &includeScanner{exists: make(map[string]bool),
+		includes: make(map[string][]string)}
+}
+
+// Return the names in a file's #include "..." directives, reading it only if
+// it changed since it was last scanned.
+func scanIncludes(name string, info os.FileInfo) []string {
+	mtime := strconv.FormatInt(info.ModTime().UnixNano(), 10)
+	if value, ok := scanEntries.get(name); ok {
+		fields := strings.Split(value, "\t")
+		if fields[0] == mtime {
+			return fields[1:]
+		}
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	includes := make([]string, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		if m := includeDirective.FindStringSubmatch(scanner.Text()); m != nil {
+			includes = append(includes, m[1])
+		}
+	}
+
+	scanEntries.set(name, strings.Join(append([]string{mtime}, includes...), "\t"))
+	return includes
+}
+
+// True if a file exists, or is made by a rule, returning what it includes if
+// it exists.
+func (sc *includeScanner) lookup(rs *ruleSet, name string) (bool, []string) {
+	sc.mutex.Lock()
+	exists, ok := sc.exists[name]
+	includes := sc.includes[name]
+	sc.mutex.Unlock()
+	if ok {
+		return exists, includes
+	}
+
+	info, err := os.Stat(name)
+	if err == nil && !info.IsDir() {
+		exists = true
+		includes = scanIncludes(name, info)
+	} else {
+		_, exists = rs.targetrules[name]
+	}
+
+	sc.mutex.Lock()
+	sc.exists[name] = exists
+	sc.includes[name] = includes
+	sc.mutex.Unlock()
+	return exists, includes
+}
+
+// Return the headers included, directly or not, by the given files, in the
+// order they're found.
+func (g *graph) scanHeaders(r *rule, sources []string) []string {
+	sc := g.scan
+	headers := make([]string, 0)
+	seen := make(map[string]bool)
+	queue := make([]string, 0, len(sources))
+	for _, source := range sources {
+		seen[source] = true
+		queue = append(queue, source)
+	}
+
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		_, includes := sc.lookup(g.rules, name)
+
+		for _, inc := range includes {
+			dirs := append([]string{filepath.Dir(name)}, r.incpath...)
+			for _, dir := range dirs {
+				header := filepath.Join(dir, inc)
+				if exists, _ := sc.lookup(g.rules, header); !exists {
+					continue
+				}
+				if !seen[header] {
+					seen[header] = true
+					headers = append(headers, header)
+					queue = append(queue, header)
+				}
+				break
+			}
+		}
+	}
+	return headers
+}
+
+// Add edges from a node to the headers its rule's prerequisites include. They
+// get a recipeless rule of their own, so they aren't part of $prereq, which is
+// pruned along with the rule.
+func (g *graph) addHeaderEdges(rs *ruleSet, u *node, r *rule, sources []string, rulecnt []int) {
+	headers := g.scanHeaders(r, sources)
+	if len(headers) == 0 {
+		return
+	}
+
+	hr := &rule{targets: []pattern{pattern{spat: u.name}}, prereqs: headers,
+		file: r.file, line: r.line, scanned: r}
+	vs := applyprereqs(rs, g, headers, rulecnt)
+	for i := range vs {
+		u.newedge(vs[i], hr)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScanIncludes(t *testing.T) {
+	rule := "%.o:I: %.c\n\tcc -c $prereq\n"
+	tests := []struct {
+		mkfile string
+		files  map[string]string
+		edges  string
+	}{
+		{rule, map[string]string{"x.c": "#include \"a.h\"\n", "a.h": "# include \"b.h\"\n", "b.h": ""},
+			"x.c, a.h, b.h"},
+		// headers that can't be found, or are included with <...>, are ignored
+		{rule, map[string]string{"x.c": "#include \"none.h\"\n#include <stdio.h>\n"}, "x.c"},
+		{rule + "gen.h:\n\ttouch gen.h\n", map[string]string{"x.c": "#include \"gen.h\"\n"},
+			"x.c, gen.h"},
+		{"includepath=inc\n" + rule, map[string]string{"x.c": "#include \"c.h\"\n", "inc/c.h": ""},
+			"x.c, inc/c.h"},
+		// next to the including file comes first
+		{"includepath=inc\n" + rule, map[string]string{"x.c": "#include \"sub/d.h\"\n",
+			"sub/d.h": "#include \"e.h\"\n", "sub/e.h": "", "inc/e.h": ""}, "x.c, sub/d.h, sub/e.h"},
+		// each header once, however often it's included
+		{rule, map[string]string{"x.c": "#include \"a.h\"\n#include \"b.h\"\n",
+			"a.h": "#include \"b.h\"\n", "b.h": "#include \"a.h\"\n"}, "x.c, a.h, b.h"},
+		// only with the attribute
+		{"%.o: %.c\n\tcc -c $prereq\n", map[string]string{"x.c": "#include \"a.h\"\n", "a.h": ""}, "x.c"},
+	}
+	for _, test := range tests {
+		inTempDir(t, test.files)
+		g := testGraph(t, test.mkfile, "x.o")
+		if got := edgeNames(g.nodes["x.o"]); got != test.edges {
+			t.Errorf("%q with %v: edges %q, want %q", test.mkfile, test.files, got, test.edges)
+		}
+	}
+}
+
+// What a file includes is read again only once its modification time changes.
+func TestScanCache(t *testing.T) {
+	mkfile := "%.o:I: %.c\n\tcc -c $prereq\n"
+	inTempDir(t, map[string]string{"x.c": "#include \"a.h\"\n", "a.h": "", "b.h": ""})
+	old := time.Now().Add(-time.Hour)
+
+	steps := []struct {
+		contents string
+		touch    bool
+		edges    string
+	}{
+		{"", false, "x.c, a.h"},
+		// the recorded includes are used while the time is the same
+		{"#include \"b.h\"\n", false, "x.c, a.h"},
+		{"", true, "x.c, b.h"},
+	}
+	for i, step := range steps {
+		if step.contents != "" {
+			if err := ioutil.WriteFile("x.c", []byte(step.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mtime := old
+		if step.touch {
+			mtime = time.Now()
+		}
+		if err := os.Chtimes("x.c", mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+
+		g := testGraph(t, mkfile, "x.o")
+		got := edgeNames(g.nodes["x.o"])
+		if got != step.edges {
+			t.Errorf("step %d: edges %q, want %q", i, got, step.edges)
+		}
+
+		// as if by another run
+		saveState()
+		scanEntries.reset()
+		recorded, _ := ioutil.ReadFile(statePath("includes"))
+		want := fmt.Sprintf("x.c\t%d\t%s\n", mtime.UnixNano(), strings.TrimPrefix(got, "x.c, "))
+		if !strings.Contains(string(recorded), want) {
+			t.Errorf("step %d: recorded %q, want line %q", i, recorded, want)
+		}
+	}
+}
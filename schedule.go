@@ -0,0 +1,185 @@
+// Deterministic and shuffled scheduling. A deterministic build starts recipes
+// in a fixed topological order, so output is reproducible, and shuffling
+// randomizes the order, to expose missing prerequisites.
+
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// True if recipes start in a fixed order.
+var deterministic bool = false
+
+// Source of randomness when shuffling, or nil if not shuffling.
+var shuffleRand *rand.Rand
+
+// The -shuffle option, which takes an optional seed.
+type shuffleFlag struct {
+	seed int64
+	set  bool
+}
+
+func (f *shuffleFlag) String() string {
+	if f == nil || !f.set {
+		return ""
+	}
+	return strconv.FormatInt(f.seed, 10)
+}
+
+func (f *shuffleFlag) IsBoolFlag() bool { return true }
+
+func (f *shuffleFlag) Set(s string) error {
+	switch s {
+	case "true":
+		f.seed = time.Now().UnixNano()
+	case "false":
+		f.set = false
+		return nil
+	default:
+		seed, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		f.seed = seed
+	}
+	f.set = true
+	return nil
+}
+
+// Exclusivity for the order of turns, and signalled whenever one is passed.
+var turnMutex sync.Mutex
+var turnCond = sync.NewCond(&turnMutex)
+
+// Return the nodes reachable from the given ones in postorder, prerequisites
+// first, leaving out those skip is true for and what only they lead to.
+// Prerequisites are visited in the order they are written, unless shuffling.
+func turnOrder(us []*node, skip func(u *node) bool) []*node {
+	order := make([]*node, 0)
+	seen := make(map[*node]bool)
+	var visit func(u *node)
+	visit = func(u *node) {
+		seen[u] = true
+		prereqs := make([]*node, 0, len(u.prereqs))
+		for i := range u.prereqs {
+			if u.prereqs[i].v != nil {
+				prereqs = append(prereqs, u.prereqs[i].v)
+			}
+		}
+		if shuffleRand != nil {
+			sortByPriority(prereqs)
+		}
+		for _, v := range prereqs {
+			if !seen[v] && !skip(v) {
+				visit(v)
+			}
+		}
+		order = append(order, u)
+	}
+	for _, u := range us {
+		if !seen[u] && !skip(u) {
+			visit(u)
+		}
+	}
+	return order
+}
+
+// Fix the order in which the nodes reachable from the given ones take their
+// turns, prerequisites first.
+func (g *graph) numberTurns(us []*node) {
+	if !deterministic {
+		return
+	}
+
+	turnMutex.Lock()
+	defer turnMutex.Unlock()
+	for _, u := range g.nodes {
+		u.hasTurn = false
+		u.turnPassed = false
+		u.prevTurn, u.nextTurn = nil, nil
+	}
+
+	var prev *node
+	for _, u := range turnOrder(us, func(*node) bool { return false }) {
+		u.hasTurn = true
+		u.prevTurn = prev
+		if prev != nil {
+			prev.nextTurn = u
+		}
+		prev = u
+	}
+}
+
+// Wait until it's the node's turn to start its recipe.
+func waitTurn(u *node) {
+	if !deterministic {
+		return
+	}
+	turnMutex.Lock()
+	for u.hasTurn && u.prevTurn != nil && !u.prevTurn.turnPassed {
+		turnCond.Wait()
+	}
+	turnMutex.Unlock()
+}
+
+// Let the next node take its turn, after waiting for this one's. Passing a
+// turn more than once has no effect.
+func passTurn(u *node) {
+	if !deterministic {
+		return
+	}
+	waitTurn(u)
+
+	turnMutex.Lock()
+	if u.hasTurn && !u.turnPassed {
+		u.turnPassed = true
+		turnCond.Broadcast()
+	}
+	turnMutex.Unlock()
+}
+
+// Give nodes that have become prerequisites of u during the build, and what
+// they depend on, turns just before u's. Their turns may have come after u's,
+// or they may have had none. If u has no turn, nor do they.
+func insertTurns(vs []*node, u *node) {
+	if !deterministic {
+		return
+	}
+	turnMutex.Lock()
+	defer turnMutex.Unlock()
+
+	// once passed, what a node depends on is done with too
+	order := turnOrder(vs, func(v *node) bool { return v.turnPassed })
+	for _, v := range order {
+		if v.hasTurn {
+			if v.prevTurn != nil {
+				v.prevTurn.nextTurn = v.nextTurn
+			}
+			if v.nextTurn != nil {
+				v.nextTurn.prevTurn = v.prevTurn
+			}
+		}
+		v.hasTurn = false
+		v.prevTurn, v.nextTurn = nil, nil
+	}
+
+	if u.hasTurn {
+		prev := u.prevTurn
+		for _, v := range order {
+			v.hasTurn = true
+			v.prevTurn = prev
+			if prev != nil {
+				prev.nextTurn = v
+			}
+			prev = v
+		}
+		u.prevTurn = prev
+		if prev != nil {
+			prev.nextTurn = u
+		}
+	}
+	turnCond.Broadcast()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDeterministicOrder(t *testing.T) {
+	tests := []struct {
+		mkfile string
+		order  string
+	}{
+		{"all:V: c a b\n[a-z]:R:\n\techo $target >> log; touch $target\n", "c a b"},
+		{"all:V: x y\nx: z\n\techo x >> log; touch x\n" +
+			"[a-z]:R:\n\techo $target >> log; touch $target\n", "z x y"},
+		{"all:V: x y\nx: z\n\techo x >> log; touch x\ny: z\n\techo y >> log; touch y\n" +
+			"z:\n\techo z >> log; touch z\n", "z x y"},
+		// order-only prerequisites take their turns first too
+		{"all:V: x\nx: | y\n\techo x >> log; touch x\n" +
+			"y:\n\techo y >> log; touch y\n", "y x"},
+	}
+	for _, test := range tests {
+		inTempDir(t, nil)
+		g := testGraph(t, test.mkfile, "all")
+		if got := strings.Join(testOrderedBuild(t, g, -1), " "); got != test.order {
+			t.Errorf("%q: built %q, want %q", test.mkfile, got, test.order)
+		}
+	}
+}
+
+// The same seed gives the same order, and different seeds different ones.
+func TestShuffleSeed(t *testing.T) {
+	mkfile := "all:V: a b c d e f g h\n[a-h]:R:\n\techo $target >> log; touch $target\n"
+	orders := make(map[int64]string)
+	for _, seed := range []int64{1, 2, 3, 4, 5, 1, 2} {
+		inTempDir(t, nil)
+		g := testGraph(t, mkfile, "all")
+		order := strings.Join(testOrderedBuild(t, g, seed), " ")
+		if prev, ok := orders[seed]; ok && prev != order {
+			t.Errorf("seed %d: built %q, then %q", seed, prev, order)
+		}
+		orders[seed] = order
+	}
+
+	distinct := make(map[string]bool)
+	for _, order := range orders {
+		distinct[order] = true
+	}
+	if len(distinct) < 2 {
+		t.Errorf("five seeds gave the same order")
+	}
+}
+
+// Shuffling still builds prerequisites first.
+func TestShufflePrereqs(t *testing.T) {
+	mkfile := "all:V: a b c\na: b d\nb: c e\n" +
+		"[a-e]:R:\n\techo $target >> log; touch $target\n"
+	for seed := int64(0); seed < 10; seed++ {
+		inTempDir(t, nil)
+		g := testGraph(t, mkfile, "all")
+		log := testOrderedBuild(t, g, seed)
+
+		pos := make(map[string]int)
+		for i, name := range log {
+			pos[name] = i
+		}
+		for _, pair := range [][2]string{{"b", "a"}, {"d", "a"}, {"c", "b"}, {"e", "b"}} {
+			if pos[pair[0]] > pos[pair[1]] {
+				t.Errorf("seed %d: built %q, want %s before %s", seed,
+					strings.Join(log, " "), pair[0], pair[1])
+			}
+		}
+	}
+}
+
+// Return the names of nodes other than the root in the order they take their
+// turns.
+func turnNames(g *graph) string {
+	var first *node
+	for _, u := range g.nodes {
+		if u.hasTurn && u.prevTurn == nil {
+			first = u
+		}
+	}
+	names := make([]string, 0)
+	for u := first; u != nil; u = u.nextTurn {
+		if u != g.root {
+			names = append(names, u.name)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+// Prerequisites found during a build take their turns just before the target
+// they were found for.
+func TestInsertTurns(t *testing.T) {
+	tests := []struct {
+		mkfile string
+		u      string
+		vs     string
+		passed string
+		turns  string
+	}{
+		{"all:V: a b c\n", "a", "c", "", "c a b all"},
+		{"all:V: a b c\n", "b", "a", "", "a b c all"},
+		{"all:V: a b\nb: d\n", "a", "b", "", "d b a all"},
+		// what's already had its turn stays where it was
+		{"all:V: a b\nb: d\n", "a", "b", "d", "b a d all"},
+		{"all:V: a b c\nc: a\n", "b", "c", "a", "a c b all"},
+		// nodes that had no turn get one
+		{"all:V: a\n", "a", "n", "", "n a all"},
+	}
+	det := deterministic
+	deterministic = true
+	defer func() { deterministic = det }()
+
+	for _, test := range tests {
+		inTempDir(t, nil)
+		g := testGraph(t, test.mkfile, "all")
+		g.numberTurns([]*node{g.root})
+		for _, name := range strings.Fields(test.passed) {
+			g.nodes[name].turnPassed = true
+		}
+		vs := make([]*node, 0)
+		for _, name := range strings.Fields(test.vs) {
+			v, _ := g.getnode(name)
+			vs = append(vs, v)
+		}
+		insertTurns(vs, g.nodes[test.u])
+
+		desc := fmt.Sprintf("%q, %s before %s", test.mkfile, test.vs, test.u)
+		if got := turnNames(g); got != test.turns {
+			t.Errorf("%s: turns %q, want %q", desc, got, test.turns)
+		}
+	}
+}
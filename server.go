@@ -0,0 +1,346 @@
+// A long running build server. It keeps the parsed mkfile and the graphs built
+// from it in memory, keeps node timestamps fresh by watching files, and builds
+// targets on behalf of thin clients connecting over a unix socket.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// True while serving or watching builds, in which case errors fail the current
+// build rather than exiting.
+var serving bool = false
+
+// Raised by mkError in place of exiting while serving.
+type mkFailure string
+
+// State file for the server's socket.
+const serverSocketFile = "sock"
+
+// A build requested by a client.
+type serverRequest struct {
+	Targets        []string // targets to build, or none for the default
+	DryRun         bool     // -n
+	RebuildAll     bool     // -a
+	ShallowRebuild bool     // -r
+	Quiet          bool     // -q
+	Jobs           int      // -p, or 0 for the server's own
+}
+
+// Output sent to a client. The last message has Done set.
+type serverMessage struct {
+	Stream int    // 1 for standard out, 2 for standard error
+	Data   []byte // output
+	Done   bool   // the build is finished
+	Exit   int    // exit status of the build, once done
+}
+
+type server struct {
+	mkfilepath string             // mkfile being served
+	rs         *ruleSet           // parsed mkfile, nil if it needs reparsing
+	graphs     map[string]*graph  // graphs for each requested set of targets
+	paths      map[string][]*node // nodes in graphs by absolute path
+	unwatched  []*node            // nodes that must be stat'ed before each build
+	w          *watcher           // nil if files can't be watched
+	mutex      sync.Mutex         // exclusivity for everything above
+}
+
+// Serve builds until interrupted.
+func serve(mkfilepath string) {
+	s := &server{mkfilepath: mkfilepath}
+	w, err := newWatcher()
+	if err != nil {
+		mkPrintError(fmt.Sprintf("mk: %s, timestamps will be checked before every build", err))
+	} else {
+		s.w = w
+		go s.watch()
+	}
+	s.load()
+	serving = true
+
+	path := statePath(serverSocketFile)
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		mkError(fmt.Sprintf("mk: unable to listen on %s: %s", path, err))
+	}
+
+	// remove the socket when interrupted
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		os.Remove(path)
+		os.Exit(0)
+	}()
+
+	mkPrintMessage(fmt.Sprintf("mk: serving builds on %s", path))
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// one at a time, since a build's output is captured by redirecting
+		// the whole process's; other clients wait to be accepted
+		s.handle(conn)
+	}
+}
+
+// Parse the mkfile, discarding any graphs built from an earlier parse.
+func (s *server) load() {
+	rs := parseMkfile(s.mkfilepath, true)
+	addRecordedDeps(rs)
+	s.rs = rs
+	s.dropGraphs()
+	if s.w != nil {
+		for i := range rs.files {
+			s.w.add(rs.files[i])
+		}
+	}
+}
+
+// Forget every graph that has been built.
+func (s *server) dropGraphs() {
+	s.graphs = make(map[string]*graph)
+	s.paths = make(map[string][]*node)
+	s.unwatched = nil
+}
+
+// Return the graph for the given targets, building it if needed. Graphs built
+// for -a are kept apart, since which rules apply differs.
+func (s *server) graph(targets []string, all bool) *graph {
+	key := fmt.Sprint(all, "\x00", strings.Join(targets, "\x00"))
+	if g, ok := s.graphs[key]; ok {
+		return g
+	}
+
+	// the root rule differs between graphs, so add it to a copy
+	rs := s.rs.clone()
+	addRootRule(rs, targets)
+
+	g := buildgraph(rs, "")
+	s.graphs[key] = g
+	for _, u := range g.nodes {
+		if u == g.root {
+			continue
+		}
+		path, err := filepath.Abs(u.name)
+		if err != nil {
+			continue
+		}
+		s.paths[path] = append(s.paths[path], u)
+		if s.w == nil || !s.w.add(path) {
+			s.unwatched = append(s.unwatched, u)
+		}
+	}
+	return g
+}
+
+// Apply changes to files as they are reported by the watcher.
+func (s *server) watch() {
+	for path := range s.w.events {
+		s.mutex.Lock()
+		s.changed(path)
+		s.mutex.Unlock()
+	}
+}
+
+// Note a change to the file at the given path, or to any file if it's empty.
+func (s *server) changed(path string) {
+	if path == "" || s.rs == nil {
+		s.rs = nil
+		return
+	}
+
+	for i := range s.rs.files {
+		if s.rs.files[i] == path {
+			s.rs = nil
+			return
+		}
+	}
+
+	for _, u := range s.paths[path] {
+		existed := u.exists
+		u.updateTimestamp()
+		if u.exists != existed {
+			// which rules apply depends on which files exist
+			s.dropGraphs()
+			return
+		}
+	}
+}
+
+// Serve one build request.
+func (s *server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var req serverRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	enc := json.NewEncoder(conn)
+	status := capture(enc, func() int { return s.build(req) })
+	enc.Encode(serverMessage{Done: true, Exit: status})
+}
+
+// Build the requested targets, returning an exit status.
+func (s *server) build(req serverRequest) (status int) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(mkFailure); !ok {
+				panic(r)
+			}
+			status = 1
+		}
+	}()
+
+	if s.rs == nil {
+		s.load()
+	}
+
+	targets := defaultTargets(s.rs, req.Targets)
+	if len(targets) == 0 {
+		fmt.Println("mk: nothing to mk")
+		return 0
+	}
+
+	// -a changes the graph, so is set before it's built
+	all, shallow := rebuildall, rebuildtargets
+	rebuildall = req.RebuildAll
+	rebuildtargets = make(map[string]bool)
+	if req.ShallowRebuild {
+		for i := range targets {
+			rebuildtargets[targets[i]] = true
+		}
+	}
+	defer func() { rebuildall, rebuildtargets = all, shallow }()
+
+	g := s.graph(targets, req.RebuildAll)
+	if s.refreshUnwatched() {
+		g = s.graph(targets, req.RebuildAll)
+	}
+	g.reset()
+
+	quietall = req.Quiet
+	defer func() { quietall = false }()
+	if req.Jobs > 0 {
+		jobs := subprocsAllowed
+		subprocsAllowed = req.Jobs
+		defer func() { subprocsAllowed = jobs }()
+	}
+
+	g.numberTurns([]*node{g.root})
+	mkNode(g, g.root, req.DryRun, true)
+	saveState()
+
+	for _, u := range g.nodes {
+		if u.status == nodeStatusFailed {
+			return 1
+		}
+	}
+	return 0
+}
+
+// Stat the files that aren't being watched, returning true if any appeared or
+// disappeared, in which case the graphs have been dropped.
+func (s *server) refreshUnwatched() bool {
+	for _, u := range s.unwatched {
+		existed := u.exists
+		u.updateTimestamp()
+		if u.exists != existed {
+			// which rules apply depends on which files exist
+			s.dropGraphs()
+			return true
+		}
+	}
+	return false
+}
+
+// Run f, sending anything written to standard out or error to a client. This
+// redirects the whole process's output, so only one build can be captured at
+// a time.
+func capture(enc *json.Encoder, f func() int) int {
+	var encmutex sync.Mutex
+	var done sync.WaitGroup
+
+	forward := func(stream int) *os.File {
+		r, w, err := os.Pipe()
+		if err != nil {
+			log.Fatal(err)
+		}
+		done.Add(1)
+		go func() {
+			buf := make([]byte, 4096)
+			for {
+				n, err := r.Read(buf)
+				if n > 0 {
+					encmutex.Lock()
+					enc.Encode(serverMessage{Stream: stream, Data: buf[:n]})
+					encmutex.Unlock()
+				}
+				if err != nil {
+					break
+				}
+			}
+			r.Close()
+			done.Done()
+		}()
+		return w
+	}
+
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout = forward(1)
+	os.Stderr = forward(2)
+	status := f()
+	os.Stdout.Close()
+	os.Stderr.Close()
+	os.Stdout, os.Stderr = stdout, stderr
+	done.Wait()
+
+	return status
+}
+
+// Have a running server perform a build, copying its output to our own.
+// Returns the build's exit status.
+func runClient(req serverRequest) int {
+	conn, err := net.Dial("unix", filepath.Join(mkStateDir, serverSocketFile))
+	if err != nil {
+		mkError("mk: no server is running, start one with mk -server")
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		mkError(fmt.Sprintf("mk: unable to send request: %s", err))
+	}
+
+	dec := json.NewDecoder(conn)
+	for {
+		var msg serverMessage
+		if err := dec.Decode(&msg); err != nil {
+			mkError("mk: lost connection to the server")
+		}
+		if msg.Done {
+			return msg.Exit
+		}
+		if msg.Stream == 2 {
+			os.Stderr.Write(msg.Data)
+		} else {
+			os.Stdout.Write(msg.Data)
+		}
+	}
+}
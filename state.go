@@ -0,0 +1,156 @@
+// Mk keeps a small amount of state between runs in a hidden directory in the
+// working directory.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Directory in which state is kept.
+const mkStateDir = ".mk"
+
+// A file in the state directory mapping targets, or other names, to what's
+// remembered about them. Each line is a key and its value, separated by a tab.
+// The file is read the first time it's needed, and written by saveState if it
+// changed.
+type stateFile struct {
+	name    string            // file name in the state directory
+	what    string            // what it records, for error messages
+	entries map[string]string // nil until loaded
+	changed bool
+	mutex   sync.Mutex
+}
+
+// Every state file, so they can be saved together.
+var stateFiles []*stateFile
+
+func newStateFile(name, what string) *stateFile {
+	s := &stateFile{name: name, what: what}
+	stateFiles = append(stateFiles, s)
+	return s
+}
+
+// Return the path of the named state file, creating the state directory if
+// needed.
+func statePath(name string) string {
+	// errors are reported when the file itself is opened
+	os.MkdirAll(mkStateDir, 0755)
+	return filepath.Join(mkStateDir, name)
+}
+
+// Read the file, if it hasn't been already. Called with s.mutex held.
+func (s *stateFile) load() {
+	if s.entries != nil {
+		return
+	}
+	s.entries = make(map[string]string)
+
+	file, err := os.Open(filepath.Join(mkStateDir, s.name))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(fields) == 2 {
+			s.entries[fields[0]] = fields[1]
+		} else {
+			s.entries[fields[0]] = ""
+		}
+	}
+}
+
+// Return the value recorded for a key, if any.
+func (s *stateFile) get(key string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.load()
+
+	value, ok := s.entries[key]
+	return value, ok
+}
+
+// Record a key's value.
+func (s *stateFile) set(key, value string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.load()
+
+	if prev, ok := s.entries[key]; !ok || prev != value {
+		s.entries[key] = value
+		s.changed = true
+	}
+}
+
+// Forget a key.
+func (s *stateFile) remove(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.load()
+
+	if _, ok := s.entries[key]; ok {
+		delete(s.entries, key)
+		s.changed = true
+	}
+}
+
+// Return a copy of every key and value.
+func (s *stateFile) all() map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.load()
+
+	entries := make(map[string]string, len(s.entries))
+	for key, value := range s.entries {
+		entries[key] = value
+	}
+	return entries
+}
+
+// Write the file, if it has changed.
+func (s *stateFile) save() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.changed {
+		return
+	}
+
+	lines := make([]string, 0, len(s.entries))
+	for key, value := range s.entries {
+		lines = append(lines, key+"\t"+value+"\n")
+	}
+	sort.Strings(lines)
+
+	err := ioutil.WriteFile(statePath(s.name), []byte(strings.Join(lines, "")), 0644)
+	if err != nil {
+		mkPrintError(fmt.Sprintf("mk: unable to record %s: %s", s.what, err))
+		return
+	}
+	s.changed = false
+}
+
+// Forget what was read, as when the working directory changes.
+func (s *stateFile) reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entries = nil
+	s.changed = false
+}
+
+// Write any state that changed during a build.
+func saveState() {
+	for _, s := range stateFiles {
+		s.save()
+	}
+}
@@ -0,0 +1,203 @@
+// Checking the files a recipe actually touches against the graph.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// True if recipes should be run under the tracer.
+var traceaccess bool = false
+
+// True if missing prerequisites found by the tracer should be recorded.
+var tracerecord bool = false
+
+// State file in which discovered dependencies are recorded.
+const traceDepsFile = "deps"
+
+// Serialize updates to the recorded dependencies.
+var traceDepsMutex sync.Mutex
+
+// Files opened by a traced recipe, as absolute paths.
+type fileAccesses struct {
+	reads  map[string]bool
+	writes map[string]bool
+}
+
+func newFileAccesses() *fileAccesses {
+	return &fileAccesses{make(map[string]bool), make(map[string]bool)}
+}
+
+// Convert an absolute path to one relative to the working directory. Returns
+// false for files outside the working directory, or mk's own state.
+func traceRelPath(wd string, path string) (string, bool) {
+	rel, err := filepath.Rel(wd, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	if rel == mkStateDir || strings.HasPrefix(rel, mkStateDir+"/") {
+		return "", false
+	}
+	return rel, true
+}
+
+// Return the relative names of regular files in the working directory that
+// were accessed and still exist, in sorted order.
+func traceFiles(wd string, paths map[string]bool) []string {
+	names := make([]string, 0)
+	for path := range paths {
+		name, ok := traceRelPath(wd, path)
+		if !ok {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Add the names of every node u transitively depends on.
+func (u *node) collectPrereqs(names map[string]bool) {
+	for i := range u.prereqs {
+		v := u.prereqs[i].v
+		if v != nil && !names[filepath.Clean(v.name)] {
+			names[filepath.Clean(v.name)] = true
+			v.collectPrereqs(names)
+		}
+	}
+}
+
+// Compare the files a recipe opened with its node's declared prerequisites and
+// targets, reporting any that are missing.
+func checkAccesses(u *node, e *edge, acc *fileAccesses) {
+	wd, err := os.Getwd()
+	if err != nil {
+		mkError(err.Error())
+	}
+
+	declared := make(map[string]bool)
+	u.collectPrereqs(declared)
+
+	outputs := make(map[string]bool)
+	for _, target := range recipeTargets(u, e) {
+		outputs[filepath.Clean(target)] = true
+	}
+
+	// the other targets of a regular expression rule are only known as
+	// patterns
+	isOutput := func(name string) bool {
+		if outputs[name] {
+			return true
+		}
+		if e.r.attributes.regex {
+			for i := range e.r.targets {
+				if e.r.targets[i].match(name) != nil {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	written := traceFiles(wd, acc.writes)
+	for _, name := range written {
+		if !isOutput(name) {
+			mkPrintError(fmt.Sprintf("mk: recipe for %s wrote %s, which is not a target", u.name, name))
+		}
+	}
+
+	missing := make([]string, 0)
+	for _, name := range traceFiles(wd, acc.reads) {
+		wrote := false
+		for _, w := range written {
+			wrote = wrote || w == name
+		}
+		if !declared[name] && !isOutput(name) && !wrote {
+			mkPrintError(fmt.Sprintf("mk: recipe for %s read %s, which is not a prerequisite", u.name, name))
+			missing = append(missing, name)
+		}
+	}
+
+	if tracerecord && len(missing) > 0 {
+		recordDeps(u.name, missing)
+	}
+}
+
+// Read recorded dependencies, returning a set of "target\tprereq" lines.
+func readRecordedDeps(path string) map[string]bool {
+	deps := make(map[string]bool)
+	file, err := os.Open(path)
+	if err != nil {
+		return deps
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if strings.Count(scanner.Text(), "\t") == 1 {
+			deps[scanner.Text()] = true
+		}
+	}
+	return deps
+}
+
+// Record prerequisites discovered for a target, to be added to the graph on
+// the next run.
+func recordDeps(target string, prereqs []string) {
+	traceDepsMutex.Lock()
+	defer traceDepsMutex.Unlock()
+
+	path := statePath(traceDepsFile)
+	deps := readRecordedDeps(path)
+	for i := range prereqs {
+		deps[target+"\t"+prereqs[i]] = true
+	}
+
+	lines := make([]string, 0, len(deps))
+	for line := range deps {
+		lines = append(lines, line+"\n")
+	}
+	sort.Strings(lines)
+
+	err := ioutil.WriteFile(path, []byte(strings.Join(lines, "")), 0644)
+	if err != nil {
+		mkPrintError(fmt.Sprintf("mk: unable to record dependencies: %s", err))
+	}
+}
+
+// Add recorded dependencies to a rule set as recipeless rules. Dependencies on
+// files that have since disappeared, and have no rule, are ignored.
+func addRecordedDeps(rs *ruleSet) {
+	path := filepath.Join(mkStateDir, traceDepsFile)
+	lines := make([]string, 0)
+	for line := range readRecordedDeps(path) {
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+
+	for i, line := range lines {
+		fields := strings.Split(line, "\t")
+		target, prereq := fields[0], fields[1]
+		if _, err := os.Stat(prereq); err != nil && rs.targetrules[prereq] == nil {
+			continue
+		}
+
+		r := rule{}
+		r.targets = []pattern{pattern{spat: target}}
+		r.prereqs = []string{prereq}
+		r.file = path
+		r.line = i + 1
+		rs.add(r)
+	}
+}
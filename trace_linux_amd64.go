@@ -0,0 +1,302 @@
+//go:build linux && amd64
+// +build linux,amd64
+
+// Tracing the files opened by a recipe with ptrace.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+)
+
+const traceSupported = true
+
+// System calls that open files.
+const (
+	sysOpen    = 2
+	sysCreat   = 85
+	sysOpenat  = 257
+	sysOpenat2 = 437
+)
+
+// System calls that move a process out of the recipe's process group.
+const (
+	sysSetpgid = 109
+	sysSetsid  = 112
+)
+
+// Report forks, clones, and execs, and mark system call stops.
+const ptraceOptions = syscall.PTRACE_O_TRACESYSGOOD |
+	syscall.PTRACE_O_TRACEFORK |
+	syscall.PTRACE_O_TRACEVFORK |
+	syscall.PTRACE_O_TRACECLONE |
+	syscall.PTRACE_O_TRACEEXEC |
+	0x100000 // PTRACE_O_EXITKILL
+
+// Only wait on tracees of the tracing thread, not on other recipes.
+const waitTracees = syscall.WALL | 0x20000000 // __WNOTHREAD
+
+// Stop tracing a process, letting it run on untraced. Called with the process
+// in a ptrace stop.
+func traceRelease(pid int) {
+	syscall.PtraceDetach(pid)
+}
+
+// Stop tracing a process that may be running: stop it, wait for it to stop,
+// and let it go. Any stop still pending is cancelled by continuing it.
+func traceReleaseRunning(pid int) {
+	syscall.RawSyscall(syscall.SYS_TKILL, uintptr(pid), uintptr(syscall.SIGSTOP), 0)
+	for {
+		var status syscall.WaitStatus
+		_, err := syscall.Wait4(pid, &status, waitTracees, nil)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil || status.Exited() || status.Signaled() {
+			return
+		}
+
+		sig := status.StopSignal()
+		if sig == syscall.SIGSTOP {
+			traceRelease(pid)
+			syscall.Kill(pid, syscall.SIGCONT)
+			return
+		}
+
+		// system call and event stops aren't signals to pass on
+		if sig&syscall.SIGTRAP != 0 {
+			sig = 0
+		}
+		syscall.PtraceCont(pid, int(sig))
+	}
+}
+
+// An open call that has been entered but has not yet returned.
+type traceOpen struct {
+	path  string
+	flags int
+}
+
+// Read a NUL terminated string from a tracee's memory.
+func tracePeekString(pid int, addr uintptr) string {
+	buf := make([]byte, 0, 256)
+	chunk := make([]byte, 64)
+	for len(buf) < 4096 {
+		n, err := syscall.PtracePeekData(pid, addr, chunk)
+		if err != nil {
+			break
+		}
+		for i := 0; i < n; i++ {
+			if chunk[i] == 0 {
+				return string(buf)
+			}
+			buf = append(buf, chunk[i])
+		}
+		addr += uintptr(n)
+	}
+	return string(buf)
+}
+
+// Decode an open call on entry, returning nil for any other system call.
+func traceOpenEntry(pid int, regs *syscall.PtraceRegs) *traceOpen {
+	dirfd := int32(-100) // AT_FDCWD
+	var op traceOpen
+	switch regs.Orig_rax {
+	case sysOpen:
+		op.path = tracePeekString(pid, uintptr(regs.Rdi))
+		op.flags = int(regs.Rsi)
+	case sysCreat:
+		op.path = tracePeekString(pid, uintptr(regs.Rdi))
+		op.flags = syscall.O_CREAT | syscall.O_WRONLY | syscall.O_TRUNC
+	case sysOpenat:
+		dirfd = int32(regs.Rdi)
+		op.path = tracePeekString(pid, uintptr(regs.Rsi))
+		op.flags = int(regs.Rdx)
+	case sysOpenat2:
+		// flags are the first field of struct open_how
+		dirfd = int32(regs.Rdi)
+		op.path = tracePeekString(pid, uintptr(regs.Rsi))
+		how := make([]byte, 8)
+		syscall.PtracePeekData(pid, uintptr(regs.Rdx), how)
+		op.flags = int(how[0]) | int(how[1])<<8 | int(how[2])<<16 | int(how[3])<<24
+	default:
+		return nil
+	}
+
+	if !filepath.IsAbs(op.path) {
+		dir := fmt.Sprintf("/proc/%d/cwd", pid)
+		if dirfd != -100 {
+			dir = fmt.Sprintf("/proc/%d/fd/%d", pid, dirfd)
+		}
+		base, err := os.Readlink(dir)
+		if err != nil {
+			return nil
+		}
+		op.path = filepath.Join(base, op.path)
+	}
+	op.path = filepath.Clean(op.path)
+	return &op
+}
+
+// Execute a subprocess under ptrace, like subprocessTo, recording the files
+// opened by it and any of its children.
+//
+// The subprocess gets a process group of its own, and only processes in it
+// are waited on, so other children of mk are left alone. Processes leaving the
+// group, such as daemons, are no longer traced, and nor is anything still
+// running once the subprocess itself exits.
+//
+// Returns
+//   (success, accesses)
+//
+func tracedSubprocess(program string, args []string, input string, stdout *os.File, stderr *os.File) (bool, *fileAccesses) {
+	program_path, err := exec.LookPath(program)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	proc_args := []string{program}
+	proc_args = append(proc_args, args...)
+
+	stdin_pipe_read, stdin_pipe_write, err := os.Pipe()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// every ptrace request must come from the thread that started the tracee
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	attr := os.ProcAttr{
+		Files: []*os.File{stdin_pipe_read, stdout, stderr},
+		Sys:   &syscall.SysProcAttr{Ptrace: true, Setpgid: true},
+	}
+
+	proc, err := os.StartProcess(program_path, proc_args, &attr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stdin_pipe_read.Close()
+	pid := proc.Pid
+	proc.Release()
+
+	go func() {
+		stdin_pipe_write.WriteString(input)
+		stdin_pipe_write.Close()
+	}()
+
+	// the tracee stops before running the program
+	var status syscall.WaitStatus
+	_, err = syscall.Wait4(pid, &status, syscall.WALL, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = syscall.PtraceSetOptions(pid, ptraceOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	syscall.PtraceSyscall(pid, 0)
+
+	acc := newFileAccesses()
+	opening := make(map[int]*traceOpen)
+	insyscall := make(map[int]bool)
+	traced := map[int]bool{pid: true}
+	seen := map[int]bool{pid: true}
+	success := false
+	for {
+		wpid, err := syscall.Wait4(-pid, &status, waitTracees, nil)
+		if err == syscall.EINTR {
+			continue
+		} else if err == syscall.ECHILD {
+			break
+		} else if err != nil {
+			log.Fatal(err)
+		}
+
+		if status.Exited() || status.Signaled() {
+			delete(traced, wpid)
+			delete(opening, wpid)
+			delete(insyscall, wpid)
+			if wpid == pid {
+				success = status.Exited() && status.ExitStatus() == 0
+				break
+			}
+			continue
+		}
+		traced[wpid] = true
+
+		if !status.Stopped() {
+			continue
+		}
+
+		sig := status.StopSignal()
+		switch {
+		case sig == syscall.SIGTRAP|0x80:
+			var regs syscall.PtraceRegs
+			if syscall.PtraceGetRegs(wpid, &regs) == nil {
+				regroup := regs.Orig_rax == sysSetsid || regs.Orig_rax == sysSetpgid
+				if insyscall[wpid] && regroup && int64(regs.Rax) >= 0 {
+					// processes can't be waited on once out of the group
+					released := false
+					for tid := range traced {
+						if pgid, err := syscall.Getpgid(tid); err != nil || pgid == pid {
+							continue
+						}
+						if tid == wpid {
+							traceRelease(tid)
+							released = true
+						} else {
+							traceReleaseRunning(tid)
+						}
+						delete(traced, tid)
+						delete(opening, tid)
+						delete(insyscall, tid)
+					}
+					if released {
+						continue
+					}
+				}
+
+				if !insyscall[wpid] {
+					opening[wpid] = traceOpenEntry(wpid, &regs)
+				} else if op := opening[wpid]; op != nil && int64(regs.Rax) >= 0 {
+					mode := op.flags & syscall.O_ACCMODE
+					if mode == syscall.O_RDONLY || mode == syscall.O_RDWR {
+						acc.reads[op.path] = true
+					}
+					if mode != syscall.O_RDONLY || op.flags&syscall.O_CREAT != 0 {
+						acc.writes[op.path] = true
+					}
+				}
+			}
+			insyscall[wpid] = !insyscall[wpid]
+			sig = 0
+
+		case sig == syscall.SIGTRAP && status.TrapCause() > 0:
+			// fork, clone, or exec event
+			if child, err := syscall.PtraceGetEventMsg(wpid); err == nil && status.TrapCause() != syscall.PTRACE_EVENT_EXEC {
+				traced[int(child)] = true
+			}
+			sig = 0
+
+		case sig == syscall.SIGSTOP && !seen[wpid]:
+			// a new child, automatically attached
+			sig = 0
+		}
+		seen[wpid] = true
+
+		syscall.PtraceSyscall(wpid, int(sig))
+	}
+
+	// whatever the subprocess left running in the background carries on
+	for tid := range traced {
+		traceReleaseRunning(tid)
+	}
+
+	return success, acc
+}
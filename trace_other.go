@@ -0,0 +1,14 @@
+//go:build !linux || !amd64
+// +build !linux !amd64
+
+package main
+
+import "os"
+
+const traceSupported = false
+
+// Tracing is unsupported on this platform, so just run the recipe.
+func tracedSubprocess(program string, args []string, input string, stdout *os.File, stderr *os.File) (bool, *fileAccesses) {
+	_, success := subprocessTo(program, args, input, false, stdout, stderr)
+	return success, newFileAccesses()
+}
@@ -0,0 +1,168 @@
+// Watch mode: rebuild targets whenever their sources change.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// How long changes must stop for before rebuilding.
+const watchDebounce = 200 * time.Millisecond
+
+// Rebuild the targets of a graph whenever a leaf node changes, reparsing if a
+// mkfile changes. Never returns.
+func watchBuild(mkfilepath string, quiet bool, targets []string, rs *ruleSet,
+	g *graph, dryrun bool) {
+	w, err := newWatcher()
+	if err != nil {
+		mkError(fmt.Sprintf("mk: %s", err))
+	}
+
+	// a broken mkfile or a failed build shouldn't end the watch
+	serving = true
+
+	for {
+		mkfiles := make(map[string]bool)
+		for i := range rs.files {
+			mkfiles[rs.files[i]] = true
+			w.add(rs.files[i])
+		}
+
+		leaves := make(map[string]*node)
+		for _, u := range g.nodes {
+			if u != g.root && len(u.prereqs) == 0 {
+				path, err := filepath.Abs(u.name)
+				if err == nil {
+					leaves[path] = u
+					w.add(path)
+				}
+			}
+		}
+
+		mkPrintMessage("mk: watching for changes")
+		changed, reparse, regraph := watchChanges(w, mkfiles, leaves)
+
+		if reparse {
+			nrs, ng := watchReload(mkfilepath, quiet, targets, dryrun)
+			if ng == nil {
+				continue
+			}
+			rs, g = nrs, ng
+		} else if regraph {
+			ng := watchRegraph(rs)
+			if ng == nil {
+				continue
+			}
+			g = ng
+		} else {
+			g.reset()
+		}
+
+		// only targets depending on what changed need to be rebuilt
+		affected := make([]*node, 0)
+		for i := range targets {
+			u, ok := g.nodes[targets[i]]
+			if !ok {
+				continue
+			}
+			prereqs := map[string]bool{filepath.Clean(u.name): true}
+			u.collectPrereqs(prereqs)
+			dirty := reparse || regraph
+			for name := range changed {
+				dirty = dirty || prereqs[name]
+			}
+			if dirty {
+				affected = append(affected, u)
+			}
+		}
+
+		watchMk(g, affected, dryrun)
+	}
+}
+
+// Wait for leaves or mkfiles to change, returning the names of changed
+// leaves, whether a mkfile changed, and whether any leaf appeared or
+// disappeared, which can change which rules apply.
+func watchChanges(w *watcher, mkfiles map[string]bool,
+	leaves map[string]*node) (map[string]bool, bool, bool) {
+	changed := make(map[string]bool)
+	reparse, regraph := false, false
+	var quiet <-chan time.Time
+	for {
+		select {
+		case path := <-w.events:
+			if path == "" || mkfiles[path] {
+				reparse = true
+			} else if u, ok := leaves[path]; ok {
+				t, existed := u.t, u.exists
+				u.updateTimestamp()
+				if u.exists != existed {
+					regraph = true
+				} else if u.t.Equal(t) {
+					continue
+				}
+				changed[filepath.Clean(u.name)] = true
+			} else {
+				continue
+			}
+			quiet = time.After(watchDebounce)
+
+		case <-quiet:
+			return changed, reparse, regraph
+		}
+	}
+}
+
+// Reparse the mkfile and rebuild the graph, returning nil if either fails.
+func watchReload(mkfilepath string, quiet bool, targets []string, dryrun bool) (rs *ruleSet, g *graph) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(mkFailure); !ok {
+				panic(r)
+			}
+			rs, g = nil, nil
+		}
+	}()
+
+	rs = parseMkfile(mkfilepath, !dryrun)
+	if quiet {
+		for i := range rs.rules {
+			rs.rules[i].attributes.quiet = true
+		}
+	}
+	addRecordedDeps(rs)
+	addRootRule(rs, targets)
+	return rs, buildgraph(rs, "")
+}
+
+// Rebuild the graph, returning nil if it fails.
+func watchRegraph(rs *ruleSet) (g *graph) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(mkFailure); !ok {
+				panic(r)
+			}
+			g = nil
+		}
+	}()
+	return buildgraph(rs, "")
+}
+
+// Build the given nodes of a graph.
+func watchMk(g *graph, us []*node, dryrun bool) {
+	if len(us) == 0 {
+		return
+	}
+	g.numberTurns(us)
+	mkNodePrereqs(g, g.root, nil, us, dryrun, true)
+	saveState()
+	for _, u := range g.nodes {
+		if u.status == nodeStatusFailed {
+			mkPrintError("mk: build failed")
+			return
+		}
+	}
+	mkPrintSuccess("mk: done")
+}
@@ -0,0 +1,100 @@
+// Watching files for changes with inotify.
+
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Events that may change a file's timestamp or existence.
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+	syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO
+
+// Watches directories, reporting changes to the files within them.
+type watcher struct {
+	fd      int              // inotify instance
+	dirs    map[int32]string // watch descriptors to absolute directory paths
+	watched map[string]bool  // directories being watched
+	mutex   sync.Mutex       // exclusivity for dirs and watched
+	events  chan string      // absolute paths of changed files, "" on overflow
+}
+
+// Start a new watcher.
+func newWatcher() (*watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	w := &watcher{fd, make(map[int32]string), make(map[string]bool),
+		sync.Mutex{}, make(chan string, 1024)}
+	go w.run()
+	return w, nil
+}
+
+// Watch for changes to a file, by watching its directory. Returns false if the
+// directory can't be watched, e.g. because it doesn't exist yet.
+func (w *watcher) add(path string) bool {
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return false
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.watched[dir] {
+		return true
+	}
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, watchMask)
+	if err != nil {
+		return false
+	}
+	w.dirs[int32(wd)] = dir
+	w.watched[dir] = true
+	return true
+}
+
+// Read events, sending the paths of changed files.
+func (w *watcher) run() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil || n <= 0 {
+			close(w.events)
+			return
+		}
+
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameoff := off + syscall.SizeofInotifyEvent
+			off = nameoff + int(ev.Len)
+
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				w.events <- ""
+				continue
+			}
+
+			w.mutex.Lock()
+			dir, ok := w.dirs[ev.Wd]
+			if ev.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, ev.Wd)
+				delete(w.watched, dir)
+			}
+			w.mutex.Unlock()
+			if !ok || ev.Len == 0 {
+				continue
+			}
+
+			name := buf[nameoff : nameoff+int(ev.Len)]
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			w.events <- filepath.Join(dir, string(name))
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// File watching is only implemented on Linux.
+type watcher struct {
+	events chan string
+}
+
+func newWatcher() (*watcher, error) {
+	return nil, errors.New("watching files is not supported on this platform")
+}
+
+func (w *watcher) add(path string) bool {
+	return false
+}